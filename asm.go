@@ -140,7 +140,7 @@ const (
 
 type Addr struct {
 	Reg    Register
-	Offset uint64
+	Offset int64 // D-format byte offset, or branch offset in instructions
 	Label  string
 }
 
@@ -150,11 +150,18 @@ type Instruction struct {
 	From  Addr     // 1st operand
 	Reg   Register // 2nd operand register
 	Imm   uint64   // 2nd operand for iformat
+	Shift uint8    // LSL amount for iwformat
 	Label string
+	Data  []byte // bytes reserved by a data directive
+	Pos   Pos    // where the instruction was parsed from
+
+	// Pseudo is the pseudo-instruction this instruction is part of the
+	// expansion of, if any.
+	Pseudo *Instruction
 }
 
 func (as Instruction) writeString(s *strings.Builder) {
-	f, ok := opcodes[as.Op]
+	f, ok := lookupFormat(as.Op)
 	if !ok {
 		return
 	}
@@ -163,6 +170,9 @@ func (as Instruction) writeString(s *strings.Builder) {
 		s.WriteString(": ")
 	}
 	s.WriteString(as.Op)
+	if f.s == nil {
+		return
+	}
 	s.WriteByte(' ')
 	f.s(s, as)
 }
@@ -180,11 +190,9 @@ func (as Instruction) registerPrefix() rune {
 			return 'S'
 		}
 		return 'D'
-	case as.Op == "LDURS":
-	case as.Op == "STURS":
+	case as.Op == "LDURS", as.Op == "STURS":
 		return 'S'
-	case as.Op == "LDURD":
-	case as.Op == "STURD":
+	case as.Op == "LDURD", as.Op == "STURD":
 		return 'D'
 	}
 	return 'X'
@@ -192,6 +200,50 @@ func (as Instruction) registerPrefix() rune {
 
 type Program []Instruction
 
+// layout splits p into its instructions and the contents of its data
+// segment, and maps each label to the address it refers to. A label on
+// a directive that reserves nothing refers to the end of the section it
+// appears in.
+func (p Program) layout() (labels map[string]uint64, text Program, data []byte) {
+	labels, text, data, _ = p.place()
+	return labels, text, data
+}
+
+// place is like layout, and also returns the address each instruction of
+// p is placed at.
+func (p Program) place() (labels map[string]uint64, text Program, data []byte, addrs []uint64) {
+	labels = make(map[string]uint64)
+	inData := false
+	for _, as := range p {
+		_, directive := directives[as.Op]
+		if as.Op == ".align" {
+			for n := uint64(1) << as.Imm; uint64(len(data))%n != 0; {
+				data = append(data, 0)
+			}
+		}
+		addr := TextOffset + 4*uint64(len(text))
+		if inData || isData(as.Op) {
+			addr = DataOffset + uint64(len(data))
+		}
+		addrs = append(addrs, addr)
+		if as.Label != "" {
+			labels[as.Label] = addr
+		}
+		switch {
+		case !directive:
+			text = append(text, as.expand()...)
+		case as.Op == ".text", as.Op == ".data":
+			inData = as.Op == ".data"
+		default:
+			data = append(data, as.Data...)
+		}
+	}
+	return labels, text, data, addrs
+}
+
+// String returns the source of p, printing expanded pseudo-instructions
+// in their original form. Use p.Expand().String() to print the
+// expansions instead.
 func (p Program) String() string {
 	indent := 0
 	for _, as := range p {
@@ -203,7 +255,13 @@ func (p Program) String() string {
 		indent += 2
 	}
 	sb := &strings.Builder{}
-	for _, as := range p {
+	for i, as := range p {
+		if as.Pseudo != nil {
+			if i > 0 && p[i-1].Pseudo == as.Pseudo {
+				continue
+			}
+			as = *as.Pseudo
+		}
 		n := 0
 		if as.Label != "" {
 			n = (len(as.Label) + 2)
@@ -220,77 +278,83 @@ func (p Program) String() string {
 type insFormat struct {
 	p formatParser
 	s func(w io.Writer, as Instruction)
+	e formatEncoder
+	d formatDecoder
 }
 
 var (
-	rformat  = insFormat{rformatParser, rformatString}
-	iformat  = insFormat{iformatParser, iformatString}
-	dformat  = insFormat{dformatParser, dformatString}
-	bformat  = insFormat{bformatParser, bformatString}
-	cbformat = insFormat{cbformatParser, cbformatString}
-	iwformat = insFormat{iwformatParser, iwformatString}
-	imformat = insFormat{}
+	rformat  = insFormat{rformatParser, rformatString, rformatEncoder, rformatDecoder}
+	iformat  = insFormat{iformatParser, iformatString, iformatEncoder, iformatDecoder}
+	shformat = insFormat{iformatParser, iformatString, shformatEncoder, shformatDecoder}
+	dformat  = insFormat{dformatParser, dformatString, dformatEncoder, dformatDecoder}
+	bformat  = insFormat{bformatParser, bformatString, bformatEncoder, bformatDecoder}
+	cbformat = insFormat{cbformatParser, cbformatString, cbformatEncoder, cbformatDecoder}
+	iwformat = insFormat{iwformatParser, iwformatString, iwformatEncoder, iwformatDecoder}
+	fcformat = insFormat{fcformatParser, fcformatString, fcformatEncoder, fcformatDecoder}
+	xformat  = insFormat{xformatParser, xformatString, xformatEncoder, xformatDecoder}
 )
 
 var opcodes = map[string]insFormat{
-	"ADD":   rformat,
-	"ADDI":  iformat,
-	"ADDIS": iformat,
-	"ADDS":  rformat,
-	"AND":   rformat,
-	"ANDI":  iformat,
-	"ANDIS": iformat,
-	"ANDS":  rformat,
-	"B":     bformat,
-	"B.EQ":  bformat,
-	"B.NE":  bformat,
-	"B.LT":  bformat,
-	"B.LE":  bformat,
-	"B.GT":  bformat,
-	"B.GE":  bformat,
-	"B.LO":  bformat,
-	"B.LS":  bformat,
-	"B.HI":  bformat,
-	"B.HS":  bformat,
-	"B.MI":  bformat,
-	"B.PL":  bformat,
-	"B.VS":  bformat,
-	"B.VC":  bformat,
-	"BL":    bformat,
-	"BR":    bformat,
-	"CBNZ":  cbformat,
-	"CBZ":   cbformat,
-	"EOR":   rformat,
-	"EORI":  iformat,
-	"LDUR":  dformat,
-	"LDURB": dformat,
-	"LDURH": dformat,
-	"LDURS": dformat,
-	"LDXR":  dformat,
-	"LSL":   iformat,
-	"LSR":   iformat,
-	"MOVK":  imformat,
-	"MOVZ":  imformat,
-	"ORR":   rformat,
-	"ORRI":  iformat,
-	"STUR":  dformat,
-	"STURB": dformat,
-	"STURH": dformat,
-	"STURW": dformat,
-	"STXR":  dformat,
-	"SUB":   rformat,
-	"SUBI":  iformat,
-	"SUBIS": iformat,
-	"SUBS":  rformat,
+	"ADD":    rformat,
+	"ADDI":   iformat,
+	"ADDIS":  iformat,
+	"ADDS":   rformat,
+	"AND":    rformat,
+	"ANDI":   iformat,
+	"ANDIS":  iformat,
+	"ANDS":   rformat,
+	"B":      bformat,
+	"B.EQ":   bformat,
+	"B.NE":   bformat,
+	"B.LT":   bformat,
+	"B.LE":   bformat,
+	"B.GT":   bformat,
+	"B.GE":   bformat,
+	"B.LO":   bformat,
+	"B.LS":   bformat,
+	"B.HI":   bformat,
+	"B.HS":   bformat,
+	"B.MI":   bformat,
+	"B.PL":   bformat,
+	"B.VS":   bformat,
+	"B.VC":   bformat,
+	"BL":     bformat,
+	"BR":     bformat,
+	"CBNZ":   cbformat,
+	"CBZ":    cbformat,
+	"EOR":    rformat,
+	"EORI":   iformat,
+	"LDUR":   dformat,
+	"LDURB":  dformat,
+	"LDURH":  dformat,
+	"LDURS":  dformat,
+	"LDURSW": dformat,
+	"LDXR":   dformat,
+	"LSL":    shformat,
+	"LSR":    shformat,
+	"MOVK":   iwformat,
+	"MOVZ":   iwformat,
+	"ORR":    rformat,
+	"ORRI":   iformat,
+	"STUR":   dformat,
+	"STURB":  dformat,
+	"STURH":  dformat,
+	"STURW":  dformat,
+	"STXR":   xformat,
+	"SUB":    rformat,
+	"SUBI":   iformat,
+	"SUBIS":  iformat,
+	"SUBS":   rformat,
 
 	"FADDS": rformat,
 	"FADDD": rformat,
-	"FCMPS": rformat,
-	"FCMPD": rformat,
+	"FCMPS": fcformat,
+	"FCMPD": fcformat,
 	"FDIVS": rformat,
 	"FDIVD": rformat,
 	"FMULS": rformat,
 	"FMULD": rformat,
+	"FSUBS": rformat,
 	"FSUBD": rformat,
 	"LDURD": dformat,
 	"MUL":   rformat,
@@ -300,4 +364,13 @@ var opcodes = map[string]insFormat{
 	"STURD": dformat,
 	"UDIV":  rformat,
 	"UMULH": rformat,
+
+	// pseudo-instructions, see pseudoOps
+	"CMNI": cmpiformat,
+	"CMP":  cmpformat,
+	"CMPI": cmpiformat,
+	"LDA":  ldaformat,
+	"MOV":  movformat,
+	"MOVI": moviformat,
+	"NEG":  movformat,
 }
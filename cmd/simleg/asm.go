@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/sean-callahan/simleg"
+)
+
+// asm assembles a source file into an object file for link.
+func asm(args []string) {
+	fs := flag.NewFlagSet(os.Args[0]+" asm", flag.ExitOnError)
+	fs.Usage = usage
+	out := fs.String("o", "", "write the object to `file`")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+	}
+	path := fs.Arg(0)
+	if *out == "" {
+		*out = strings.TrimSuffix(path, ".asm") + ".o"
+	}
+	o, err := assemble(path)
+	if err != nil {
+		fatal("asm", err)
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := o.WriteTo(f); err != nil {
+		log.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// assemble parses the source file at path into an object.
+func assemble(path string) (*simleg.Object, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &simleg.Parser{Filename: path}
+	p.Use(bytes.NewReader(b))
+	return p.ParseObject()
+}
+
+// link assembles the source files among paths, reads the object files,
+// which end in .o, and links them all into a program.
+func link(paths []string) (simleg.Program, error) {
+	var objs []*simleg.Object
+	for _, path := range paths {
+		if !strings.HasSuffix(path, ".o") {
+			o, err := assemble(path)
+			if err != nil {
+				return nil, err
+			}
+			objs = append(objs, o)
+			continue
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		o, err := simleg.ReadObject(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		objs = append(objs, o)
+	}
+	o, err := simleg.Link(objs...)
+	if err != nil {
+		return nil, err
+	}
+	return o.Program()
+}
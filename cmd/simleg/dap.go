@@ -0,0 +1,602 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/sean-callahan/simleg"
+)
+
+// dap serves the Debug Adapter Protocol on stdin and stdout, so that an
+// editor can debug a program with its own debugger interface.
+func dap(args []string) {
+	fs := flag.NewFlagSet(os.Args[0]+" dap", flag.ExitOnError)
+	fs.Usage = usage
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		usage()
+	}
+	s := &dapServer{
+		w:        os.Stdout,
+		breaks:   make(map[string][]dapBreakpoint),
+		requests: make(chan dapRequest),
+		errc:     make(chan error, 1),
+		stops:    make(chan dapStop, 1),
+	}
+	go s.read(bufio.NewReader(os.Stdin))
+	if err := s.serve(); err != nil {
+		log.Fatalln("dap:", err)
+	}
+}
+
+type dapRequest struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+type dapResponse struct {
+	Seq        int         `json:"seq"`
+	Type       string      `json:"type"`
+	RequestSeq int         `json:"request_seq"`
+	Success    bool        `json:"success"`
+	Command    string      `json:"command"`
+	Message    string      `json:"message,omitempty"`
+	Body       interface{} `json:"body,omitempty"`
+}
+
+type dapEvent struct {
+	Seq   int         `json:"seq"`
+	Type  string      `json:"type"`
+	Event string      `json:"event"`
+	Body  interface{} `json:"body,omitempty"`
+}
+
+type dapSource struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+type dapBreakpoint struct {
+	ID       int        `json:"id,omitempty"`
+	Verified bool       `json:"verified"`
+	Message  string     `json:"message,omitempty"`
+	Source   *dapSource `json:"source,omitempty"`
+	Line     int        `json:"line,omitempty"`
+	addr     uint64
+}
+
+type dapFrame struct {
+	ID     int        `json:"id"`
+	Name   string     `json:"name"`
+	Source *dapSource `json:"source,omitempty"`
+	Line   int        `json:"line"`
+	Column int        `json:"column"`
+
+	InstructionPointerReference string `json:"instructionPointerReference"`
+}
+
+type dapVariable struct {
+	Name               string `json:"name"`
+	Value              string `json:"value"`
+	VariablesReference int    `json:"variablesReference"`
+	MemoryReference    string `json:"memoryReference,omitempty"`
+}
+
+// Variable references of the scopes of a frame.
+const (
+	dapRegisters = 1 + iota
+	dapSRegisters
+	dapDRegisters
+)
+
+// A dapCall is a call made with BL that has not returned.
+type dapCall struct {
+	site  uint64 // address of the BL
+	entry uint64 // where it branched to
+}
+
+// A dapStop is the result of running the program.
+type dapStop struct {
+	stop  simleg.Stop
+	err   error
+	calls []dapCall // when it stopped
+}
+
+// dapServer serves one debug session. Requests are handled one at a time,
+// and while the program runs only those that leave it alone are.
+type dapServer struct {
+	w   io.Writer
+	seq int
+
+	stopOnEntry bool
+	cpu         *simleg.CPU
+	exited      bool
+	calls       []dapCall // outermost first, as of the last stop
+	breaks      map[string][]dapBreakpoint
+	nbreaks     int
+
+	requests chan dapRequest
+	errc     chan error // why the client stopped sending
+	stops    chan dapStop
+
+	// While the program runs, cancel stops it, and opts and until are how
+	// it was started. If restart is set, it is started again once it
+	// stops, to pick up new breakpoints.
+	cancel  context.CancelFunc
+	opts    simleg.RunOptions
+	until   func(depth int) bool
+	reason  string // to report when until stops the program
+	paused  bool
+	restart bool
+}
+
+// read passes the messages the client sends to s.requests, until it fails.
+func (s *dapServer) read(r *bufio.Reader) {
+	for {
+		n := -1
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				s.errc <- err
+				return
+			}
+			line = strings.TrimSpace(line)
+			if line == "" {
+				break
+			}
+			if v := strings.TrimPrefix(line, "Content-Length:"); v != line {
+				if n, err = strconv.Atoi(strings.TrimSpace(v)); err != nil {
+					s.errc <- fmt.Errorf("bad header %q", line)
+					return
+				}
+			}
+		}
+		if n < 0 {
+			s.errc <- errors.New("no Content-Length header")
+			return
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			s.errc <- err
+			return
+		}
+		var m dapRequest
+		if err := json.Unmarshal(b, &m); err != nil {
+			s.errc <- err
+			return
+		}
+		if m.Type == "request" {
+			s.requests <- m
+		}
+	}
+}
+
+// send sends a response or an event to the client.
+func (s *dapServer) send(m interface{}) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(s.w, "Content-Length: %d\r\n\r\n%s", len(b), b)
+	return err
+}
+
+func (s *dapServer) respond(req dapRequest, body interface{}, err error) error {
+	s.seq++
+	res := dapResponse{Seq: s.seq, Type: "response", RequestSeq: req.Seq, Success: err == nil, Command: req.Command, Body: body}
+	if err != nil {
+		res.Message = err.Error()
+	}
+	return s.send(res)
+}
+
+func (s *dapServer) event(name string, body interface{}) error {
+	s.seq++
+	return s.send(dapEvent{Seq: s.seq, Type: "event", Event: name, Body: body})
+}
+
+// serve handles requests until the client disconnects.
+func (s *dapServer) serve() error {
+	for {
+		select {
+		case req := <-s.requests:
+			body, err := s.handle(req)
+			if err := s.respond(req, body, err); err != nil {
+				return err
+			}
+			if err := s.after(req.Command); err != nil {
+				return err
+			}
+			if req.Command == "disconnect" {
+				return nil
+			}
+		case r := <-s.stops:
+			if err := s.stopped(r); err != nil {
+				return err
+			}
+		case err := <-s.errc:
+			if s.cancel != nil {
+				s.cancel()
+				<-s.stops
+			}
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// errRunning is returned for requests that need the program to be stopped.
+var errRunning = errors.New("the program is running")
+
+// handle carries out req and returns the body of the response.
+func (s *dapServer) handle(req dapRequest) (interface{}, error) {
+	switch req.Command {
+	case "threads":
+		return map[string]interface{}{
+			"threads": []map[string]interface{}{{"id": 1, "name": "main"}},
+		}, nil
+	case "setBreakpoints":
+		return s.setBreakpoints(req.Arguments)
+	case "pause":
+		if s.cancel != nil {
+			s.paused, s.restart = true, false
+			s.cancel()
+		}
+		return nil, nil
+	case "disconnect":
+		if s.cancel != nil {
+			s.cancel()
+			<-s.stops
+			s.cancel = nil
+		}
+		return nil, nil
+	}
+	if s.cancel != nil {
+		return nil, errRunning
+	}
+
+	switch req.Command {
+	case "initialize":
+		return map[string]interface{}{
+			"supportsConfigurationDoneRequest": true,
+			"supportsReadMemoryRequest":        true,
+		}, nil
+	case "launch":
+		return nil, s.launch(req.Arguments)
+	case "configurationDone":
+		return nil, nil
+	case "continue":
+		return map[string]interface{}{"allThreadsContinued": true}, s.check()
+	case "next", "stepIn", "stepOut":
+		return nil, s.check()
+	case "stackTrace":
+		frames := s.stackTrace()
+		return map[string]interface{}{"stackFrames": frames, "totalFrames": len(frames)}, nil
+	case "scopes":
+		return map[string]interface{}{"scopes": []map[string]interface{}{
+			{"name": "Registers", "variablesReference": dapRegisters, "expensive": false},
+			{"name": "Single precision registers", "variablesReference": dapSRegisters, "expensive": false},
+			{"name": "Double precision registers", "variablesReference": dapDRegisters, "expensive": false},
+		}}, nil
+	case "variables":
+		var args struct {
+			VariablesReference int `json:"variablesReference"`
+		}
+		if err := json.Unmarshal(req.Arguments, &args); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"variables": s.variables(args.VariablesReference)}, nil
+	case "readMemory":
+		return s.readMemory(req.Arguments)
+	}
+	return nil, fmt.Errorf("unsupported request %s", req.Command)
+}
+
+// check returns an error if the program can not be run.
+func (s *dapServer) check() error {
+	switch {
+	case s.cpu == nil:
+		return errors.New("no program has been launched")
+	case s.exited:
+		return errors.New("the program has exited")
+	}
+	return nil
+}
+
+// after does what follows the response to a request, which may be to send
+// events or to run the program.
+func (s *dapServer) after(command string) error {
+	if s.cancel != nil || s.cpu == nil || s.exited {
+		return nil
+	}
+	switch command {
+	case "launch":
+		return s.event("initialized", nil)
+	case "configurationDone":
+		if s.stopOnEntry {
+			return s.event("stopped", map[string]interface{}{"reason": "entry", "threadId": 1, "allThreadsStopped": true})
+		}
+		s.start(simleg.RunOptions{}, nil, "")
+	case "continue":
+		s.start(simleg.RunOptions{}, nil, "")
+	case "stepIn":
+		s.start(simleg.RunOptions{MaxSteps: 1}, nil, "step")
+	case "next":
+		depth := len(s.calls)
+		s.start(simleg.RunOptions{}, func(n int) bool { return n <= depth }, "step")
+	case "stepOut":
+		depth := len(s.calls)
+		s.start(simleg.RunOptions{}, func(n int) bool { return n < depth }, "step")
+	}
+	return nil
+}
+
+// launch loads the program named by the arguments of a launch request.
+func (s *dapServer) launch(raw json.RawMessage) error {
+	var args struct {
+		Program     string `json:"program"`
+		Text        bool   `json:"text"`
+		StopOnEntry bool   `json:"stopOnEntry"`
+	}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return err
+	}
+	if args.Program == "" {
+		return errors.New("no program given")
+	}
+	// Breakpoints are matched against the paths instructions are parsed
+	// from, which the client gives in full.
+	path, err := filepath.Abs(args.Program)
+	if err != nil {
+		return err
+	}
+	prog, err := parseProgram([]string{path})
+	if err != nil {
+		return err
+	}
+	cpu := &simleg.CPU{}
+	load := cpu.Load
+	if args.Text {
+		load = cpu.LoadText
+	}
+	if err := load(prog); err != nil {
+		return err
+	}
+	s.cpu, s.stopOnEntry = cpu, args.StopOnEntry
+	return nil
+}
+
+// setBreakpoints replaces the breakpoints in a source file.
+func (s *dapServer) setBreakpoints(raw json.RawMessage) (interface{}, error) {
+	var args struct {
+		Source      dapSource `json:"source"`
+		Breakpoints []struct {
+			Line int `json:"line"`
+		} `json:"breakpoints"`
+	}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, err
+	}
+	breaks := make([]dapBreakpoint, len(args.Breakpoints))
+	for i, sb := range args.Breakpoints {
+		b := &breaks[i]
+		s.nbreaks++
+		b.ID, b.Line = s.nbreaks, sb.Line
+		if s.cpu == nil {
+			b.Message = "no program has been launched"
+			continue
+		}
+		addr, err := s.cpu.LineAddr(args.Source.Path, sb.Line)
+		if err != nil {
+			b.Message = err.Error()
+			continue
+		}
+		as, _ := s.cpu.Instruction(addr)
+		b.Verified, b.addr = true, addr
+		b.Source, b.Line = source(as.Pos), as.Pos.Line
+	}
+	s.breaks[args.Source.Path] = breaks
+	if s.cancel != nil && !s.paused {
+		s.restart = true
+		s.cancel()
+	}
+	return map[string]interface{}{"breakpoints": breaks}, nil
+}
+
+func source(pos simleg.Pos) *dapSource {
+	return &dapSource{Name: filepath.Base(pos.File), Path: pos.File}
+}
+
+// start runs the program with opts and the breakpoints set, and stops it
+// once until, if not nil, returns true for the number of calls that have
+// not returned. The stop is handled by stopped, and reported with reason
+// if until made it.
+func (s *dapServer) start(opts simleg.RunOptions, until func(depth int) bool, reason string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel, s.opts, s.until, s.reason, s.paused = cancel, opts, until, reason, false
+
+	run := opts
+	for _, breaks := range s.breaks {
+		for _, b := range breaks {
+			if b.Verified {
+				run.Breakpoints = append(run.Breakpoints, simleg.Breakpoint{Addr: b.addr})
+			}
+		}
+	}
+	// The calls are tracked on a copy, which is handed back when the
+	// program stops, so that requests can read s.calls meanwhile.
+	calls := append([]dapCall(nil), s.calls...)
+	run.Until = func(as simleg.Instruction) bool {
+		switch {
+		case as.Op == "BL":
+			calls = append(calls, dapCall{site: s.cpu.Registers[simleg.LR] - 4, entry: s.cpu.PC})
+		case isReturn(as) && len(calls) > 0:
+			calls = calls[:len(calls)-1]
+		}
+		return until != nil && until(len(calls))
+	}
+	go func() {
+		stop, err := s.cpu.Run(ctx, run)
+		s.stops <- dapStop{stop, err, calls}
+	}()
+}
+
+// stopped reports why the program stopped.
+func (s *dapServer) stopped(r dapStop) error {
+	s.cancel()
+	s.cancel = nil
+	s.calls = r.calls
+	body := map[string]interface{}{"threadId": 1, "allThreadsStopped": true}
+	switch r.stop.Reason {
+	case simleg.StopExited:
+		s.exited = true
+		if err := s.event("exited", map[string]interface{}{"exitCode": int64(s.cpu.Registers[simleg.X0])}); err != nil {
+			return err
+		}
+		return s.event("terminated", nil)
+	case simleg.StopFault:
+		body["reason"] = "exception"
+		body["description"] = "fault"
+		body["text"] = r.err.Error()
+	case simleg.StopCanceled:
+		if s.restart {
+			s.restart = false
+			s.start(s.opts, s.until, s.reason)
+			return nil
+		}
+		body["reason"] = "pause"
+	case simleg.StopBreakpoint:
+		var ids []int
+		for _, breaks := range s.breaks {
+			for _, b := range breaks {
+				if b.Verified && b.addr == r.stop.PC {
+					ids = append(ids, b.ID)
+				}
+			}
+		}
+		body["reason"] = "breakpoint"
+		body["hitBreakpointIds"] = ids
+	default:
+		body["reason"] = s.reason
+	}
+	return s.event("stopped", body)
+}
+
+// stackTrace returns a frame for each call that has not returned, from
+// the innermost out, with the line of the BL that made it.
+func (s *dapServer) stackTrace() []dapFrame {
+	if s.cpu == nil {
+		return nil
+	}
+	var frames []dapFrame
+	pc := s.cpu.PC
+	for i := len(s.calls); i >= 0; i-- {
+		entry := uint64(simleg.TextOffset)
+		if i > 0 {
+			entry = s.calls[i-1].entry
+		}
+		f := dapFrame{
+			ID:     len(frames) + 1,
+			Name:   fmt.Sprintf("%#x", entry),
+			Column: 1,
+
+			InstructionPointerReference: fmt.Sprintf("%#x", pc),
+		}
+		if as, ok := s.cpu.Instruction(entry); ok && as.Label != "" {
+			f.Name = as.Label
+		}
+		if as, ok := s.cpu.Instruction(pc); ok {
+			f.Source, f.Line = source(as.Pos), as.Pos.Line
+		}
+		frames = append(frames, f)
+		if i > 0 {
+			pc = s.calls[i-1].site
+		}
+	}
+	return frames
+}
+
+// variables returns the registers in the scope given by ref. They are the
+// same in every frame.
+func (s *dapServer) variables(ref int) []dapVariable {
+	var vars []dapVariable
+	if s.cpu == nil {
+		return vars
+	}
+	switch ref {
+	case dapRegisters:
+		for r := simleg.X0; r <= simleg.LR; r++ {
+			v := s.cpu.Registers[r]
+			vars = append(vars, dapVariable{
+				Name:            r.String(),
+				Value:           fmt.Sprintf("%#x (%d)", v, int64(v)),
+				MemoryReference: fmt.Sprintf("%#x", v),
+			})
+		}
+		vars = append(vars,
+			dapVariable{Name: "PC", Value: fmt.Sprintf("%#x", s.cpu.PC), MemoryReference: fmt.Sprintf("%#x", s.cpu.PC)},
+			dapVariable{Name: "NZCV", Value: s.cpu.Flags.String()})
+	case dapSRegisters:
+		for i, v := range s.cpu.FPRegisters {
+			vars = append(vars, dapVariable{
+				Name:  (simleg.S0 + simleg.Register(i)).String(),
+				Value: strconv.FormatFloat(float64(math.Float32frombits(uint32(v))), 'g', -1, 32),
+			})
+		}
+	case dapDRegisters:
+		for i, v := range s.cpu.FPRegisters {
+			vars = append(vars, dapVariable{
+				Name:  (simleg.D0 + simleg.Register(i)).String(),
+				Value: strconv.FormatFloat(math.Float64frombits(v), 'g', -1, 64),
+			})
+		}
+	}
+	return vars
+}
+
+// maxReadMemory is the most bytes a readMemory request may ask for.
+const maxReadMemory = 1 << 20
+
+func (s *dapServer) readMemory(raw json.RawMessage) (interface{}, error) {
+	var args struct {
+		MemoryReference string `json:"memoryReference"`
+		Offset          int64  `json:"offset"`
+		Count           int    `json:"count"`
+	}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, err
+	}
+	if s.cpu == nil {
+		return nil, errors.New("no program has been launched")
+	}
+	addr, err := strconv.ParseUint(args.MemoryReference, 0, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad memory reference %s", args.MemoryReference)
+	}
+	if args.Count < 0 || args.Count > maxReadMemory {
+		return nil, fmt.Errorf("bad count %d", args.Count)
+	}
+	addr += uint64(args.Offset)
+	b := make([]byte, args.Count)
+	s.cpu.Memory.Read(b, addr)
+	return map[string]interface{}{
+		"address": fmt.Sprintf("%#x", addr),
+		"data":    base64.StdEncoding.EncodeToString(b),
+	}, nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const dapProgram = `	LDA X9,value
+	LDURS S1,[X9,#0]
+	ADDI X1,XZR,#3
+	BL double
+	BL double
+	ADDI X0,X1,#0
+	B end
+double:	MOV X19,LR
+	ADD X1,X1,X1
+	BL inc
+	MOV LR,X19
+	BR LR
+inc:	ADDI X1,X1,#1
+	BR LR
+end:	ADDI X2,X0,#0
+	.data
+value:	.word 0x3FC00000
+`
+
+// dapClient sends requests to a dapServer and reads what it sends back.
+type dapClient struct {
+	t   *testing.T
+	w   io.Writer
+	r   *bufio.Reader
+	seq int
+}
+
+// A dapMessage is a response or an event.
+type dapMessage struct {
+	Type    string          `json:"type"`
+	Command string          `json:"command"`
+	Event   string          `json:"event"`
+	Success bool            `json:"success"`
+	Message string          `json:"message"`
+	Body    json.RawMessage `json:"body"`
+}
+
+func (c *dapClient) send(command string, args interface{}) {
+	c.t.Helper()
+	c.seq++
+	b, err := json.Marshal(map[string]interface{}{"seq": c.seq, "type": "request", "command": command, "arguments": args})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if _, err := fmt.Fprintf(c.w, "Content-Length: %d\r\n\r\n%s", len(b), b); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *dapClient) read() dapMessage {
+	c.t.Helper()
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "Content-Length:")))
+	if err != nil {
+		c.t.Fatalf("bad header %q", line)
+	}
+	if line, err := c.r.ReadString('\n'); err != nil || line != "\r\n" {
+		c.t.Fatalf("read %q, %v after the header", line, err)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(c.r, b); err != nil {
+		c.t.Fatal(err)
+	}
+	var m dapMessage
+	if err := json.Unmarshal(b, &m); err != nil {
+		c.t.Fatal(err)
+	}
+	return m
+}
+
+// call sends a request and decodes the body of the response into body,
+// if it is not nil.
+func (c *dapClient) call(command string, args, body interface{}) {
+	c.t.Helper()
+	c.send(command, args)
+	m := c.read()
+	if m.Type != "response" || m.Command != command || !m.Success {
+		c.t.Fatalf("%s: got %+v", command, m)
+	}
+	if body != nil {
+		if err := json.Unmarshal(m.Body, body); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+}
+
+// event reads an event and decodes its body into body, if it is not nil.
+func (c *dapClient) event(name string, body interface{}) {
+	c.t.Helper()
+	m := c.read()
+	if m.Type != "event" || m.Event != name {
+		c.t.Fatalf("got %+v, want a %s event", m, name)
+	}
+	if body != nil {
+		if err := json.Unmarshal(m.Body, body); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+}
+
+// stopped reads a stopped event and checks its reason.
+func (c *dapClient) stopped(reason string) {
+	c.t.Helper()
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	c.event("stopped", &body)
+	if body.Reason != reason {
+		c.t.Errorf("stopped for %q, want %q", body.Reason, reason)
+	}
+}
+
+// stack checks the name and line of each frame, innermost first.
+func (c *dapClient) stack(want ...string) {
+	c.t.Helper()
+	var body struct {
+		StackFrames []dapFrame `json:"stackFrames"`
+	}
+	c.call("stackTrace", map[string]interface{}{"threadId": 1}, &body)
+	var got []string
+	for _, f := range body.StackFrames {
+		got = append(got, fmt.Sprintf("%s:%d", f.Name, f.Line))
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		c.t.Errorf("stack %v, want %v", got, want)
+	}
+}
+
+// variable returns the value of the variable name in the scope ref.
+func (c *dapClient) variable(ref int, name string) string {
+	c.t.Helper()
+	var body struct {
+		Variables []dapVariable `json:"variables"`
+	}
+	c.call("variables", map[string]interface{}{"variablesReference": ref}, &body)
+	for _, v := range body.Variables {
+		if v.Name == name {
+			return v.Value
+		}
+	}
+	c.t.Errorf("no variable %s in scope %d", name, ref)
+	return ""
+}
+
+func TestDAP(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dap.asm")
+	if err := ioutil.WriteFile(path, []byte(dapProgram), 0666); err != nil {
+		t.Fatal(err)
+	}
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	s := &dapServer{
+		w:        outW,
+		breaks:   make(map[string][]dapBreakpoint),
+		requests: make(chan dapRequest),
+		errc:     make(chan error, 1),
+		stops:    make(chan dapStop, 1),
+	}
+	go s.read(bufio.NewReader(inR))
+	done := make(chan error, 1)
+	go func() {
+		done <- s.serve()
+	}()
+	timeout := time.AfterFunc(10*time.Second, func() {
+		outR.CloseWithError(errors.New("timed out"))
+		inW.CloseWithError(errors.New("timed out"))
+	})
+	defer timeout.Stop()
+	defer inW.Close()
+	c := &dapClient{t: t, w: inW, r: bufio.NewReader(outR)}
+
+	c.call("initialize", map[string]interface{}{"adapterID": "simleg"}, nil)
+	c.call("launch", map[string]interface{}{"program": path}, nil)
+	c.event("initialized", nil)
+	setBreakpoints := func(lines ...int) {
+		t.Helper()
+		var bs []map[string]int
+		for _, l := range lines {
+			bs = append(bs, map[string]int{"line": l})
+		}
+		var body struct {
+			Breakpoints []dapBreakpoint `json:"breakpoints"`
+		}
+		c.call("setBreakpoints", map[string]interface{}{"source": map[string]string{"path": path}, "breakpoints": bs}, &body)
+		for i, b := range body.Breakpoints {
+			if !b.Verified || b.Line != lines[i] {
+				t.Errorf("breakpoint at line %d: %+v", lines[i], b)
+			}
+		}
+	}
+	setBreakpoints(13)
+	c.call("configurationDone", nil, nil)
+	c.stopped("breakpoint")
+	c.stack("inc:13", "double:10", "0x400000:4")
+
+	c.call("stepOut", map[string]interface{}{"threadId": 1}, nil)
+	c.stopped("step")
+	c.stack("double:11", "0x400000:4")
+	c.call("next", map[string]interface{}{"threadId": 1}, nil)
+	c.stopped("step")
+	c.stack("double:12", "0x400000:4")
+	c.call("next", map[string]interface{}{"threadId": 1}, nil)
+	c.stopped("step")
+	c.stack("0x400000:5")
+	setBreakpoints()
+	c.call("next", map[string]interface{}{"threadId": 1}, nil)
+	c.stopped("step")
+	c.stack("0x400000:6")
+	if v := c.variable(dapRegisters, "X1"); v != "0xf (15)" {
+		t.Errorf("X1 = %s, want 0xf (15)", v)
+	}
+	if v := c.variable(dapSRegisters, "S1"); v != "1.5" {
+		t.Errorf("S1 = %s, want 1.5", v)
+	}
+	if v := c.variable(dapDRegisters, "D1"); v != "5.28426686e-315" {
+		t.Errorf("D1 = %s, want the bits of S1 as a double", v)
+	}
+
+	c.call("continue", map[string]interface{}{"threadId": 1}, nil)
+	var exited struct {
+		ExitCode int `json:"exitCode"`
+	}
+	c.event("exited", &exited)
+	if exited.ExitCode != 15 {
+		t.Errorf("exit code %d, want 15", exited.ExitCode)
+	}
+	c.event("terminated", nil)
+	c.call("disconnect", nil, nil)
+	if err := <-done; err != nil {
+		t.Errorf("serve = %v", err)
+	}
+}
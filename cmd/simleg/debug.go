@@ -0,0 +1,739 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+
+	"github.com/sean-callahan/simleg"
+)
+
+const debugHelp = `commands:
+  step [n]          run n instructions (s)
+  next [n]          like step, but run through calls made with BL (n)
+  continue          run until a breakpoint or the end (c)
+  finish            run until the current function returns with BR LR (fin)
+  reverse-step [n]  undo the last n instructions (rs)
+  reverse-next [n]  like reverse-step, but undo calls made with BL whole (rn)
+  reverse-continue  undo instructions back to a breakpoint or a write to
+                    a watchpoint (rc)
+  reverse-finish    undo instructions back to the BL that called the
+                    current function (rf)
+  last addr         show the last instruction that wrote to addr
+  break loc         stop at a label, line, file:line or *address (b)
+  watch addr [n]    stop after a write to the n bytes at addr, 8 by default
+  rwatch addr [n]   stop after a read
+  awatch addr [n]   stop after a read or a write
+  delete [n]        delete breakpoint or watchpoint n, or all of them (d)
+  info breakpoints  list the breakpoints and watchpoints (i b)
+  info registers    print the general purpose registers (i r)
+  print expr        print a register, the flags or an address (p)
+  x/nf addr         examine n bytes (b), halfwords (h), words (w) or
+                    giant words (g) of memory at addr
+  set reg value     set a register or PC
+  list [loc]        list the source around loc, or PC (l)
+  run               restart the program (r)
+  quit              leave the debugger (q)
+Addresses may add and subtract registers, labels and numbers, as in SP+16.
+An empty line repeats the last command.`
+
+// debugHistory is the number of instructions the debugger can undo.
+const debugHistory = 1 << 20
+
+// debugger runs a program one CPU at a time under the control of commands
+// read from a terminal.
+type debugger struct {
+	prog simleg.Program
+	text bool // fetch instructions from memory, as with -text
+	out  io.Writer
+
+	cpu    *simleg.CPU
+	labels map[string]uint64
+	exited bool
+
+	breaks    []breakpoint
+	nbreaks   int // breakpoints and watchpoints set so far
+	interrupt chan os.Signal
+	sources   map[string][]string
+}
+
+// debug runs the debugger on the program at paths.
+func debug(args []string) {
+	fs := flag.NewFlagSet(os.Args[0]+" debug", flag.ExitOnError)
+	fs.Usage = usage
+	text := fs.Bool("text", false, "execute the program from the text segment in memory")
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		usage()
+	}
+
+	d := &debugger{
+		prog:      readProgram(fs.Args()),
+		text:      *text,
+		out:       os.Stdout,
+		interrupt: make(chan os.Signal, 1),
+		sources:   make(map[string][]string),
+	}
+	if err := d.load(); err != nil {
+		fatal("load program", err)
+	}
+	signal.Notify(d.interrupt, os.Interrupt)
+	fmt.Fprintln(d.out, `type "help" for a list of commands`)
+	d.where()
+
+	d.repl(os.Stdin)
+}
+
+// repl reads commands from r and runs them until r ends or one quits.
+func (d *debugger) repl(r io.Reader) {
+	in := bufio.NewScanner(r)
+	var last string
+	for {
+		fmt.Fprint(d.out, "(simleg) ")
+		if !in.Scan() {
+			fmt.Fprintln(d.out)
+			return
+		}
+		line := strings.TrimSpace(in.Text())
+		if line == "" {
+			line = last
+		}
+		last = line
+		if line == "" {
+			continue
+		}
+		quit, err := d.command(strings.Fields(line))
+		if err != nil {
+			fmt.Fprintln(d.out, err)
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// A breakpoint is a breakpoint or a watchpoint, numbered as it was set.
+type breakpoint struct {
+	n     int
+	addr  uint64
+	watch *simleg.Watchpoint
+}
+
+// load starts the program again from the beginning.
+func (d *debugger) load() error {
+	d.cpu = &simleg.CPU{}
+	d.cpu.Record(debugHistory)
+	load := d.cpu.Load
+	if d.text {
+		load = d.cpu.LoadText
+	}
+	if err := load(d.prog); err != nil {
+		return err
+	}
+	d.labels = d.cpu.Labels()
+	d.exited = false
+	return nil
+}
+
+// command runs the command made up of args and reports whether it was
+// quit.
+func (d *debugger) command(args []string) (quit bool, err error) {
+	name, spec := args[0], ""
+	if i := strings.Index(name, "/"); i >= 0 {
+		name, spec = name[:i], name[i+1:]
+	}
+	args = args[1:]
+	count := func() (int, error) {
+		if len(args) == 0 {
+			return 1, nil
+		}
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 1 {
+			return 0, fmt.Errorf("bad count %s", args[0])
+		}
+		return n, nil
+	}
+	switch name {
+	case "s", "step":
+		n, err := count()
+		if err != nil {
+			return false, err
+		}
+		d.run(false, simleg.RunOptions{MaxSteps: n})
+	case "n", "next":
+		n, err := count()
+		if err != nil {
+			return false, err
+		}
+		depth := 0 // calls made with BL that have not returned
+		d.run(false, simleg.RunOptions{Until: func(as simleg.Instruction) bool {
+			switch {
+			case as.Op == "BL":
+				depth++
+			case isReturn(as) && depth > 0:
+				depth--
+			}
+			if depth == 0 {
+				n--
+			}
+			return n == 0
+		}})
+	case "c", "continue":
+		d.run(false, simleg.RunOptions{})
+	case "fin", "finish":
+		depth := 0
+		d.run(false, simleg.RunOptions{Until: func(as simleg.Instruction) bool {
+			switch {
+			case as.Op == "BL":
+				depth++
+			case isReturn(as):
+				if depth == 0 {
+					return true
+				}
+				depth--
+			}
+			return false
+		}})
+	case "rs", "reverse-step":
+		n, err := count()
+		if err != nil {
+			return false, err
+		}
+		d.run(true, simleg.RunOptions{MaxSteps: n})
+	case "rn", "reverse-next":
+		n, err := count()
+		if err != nil {
+			return false, err
+		}
+		depth := 0 // returns undone whose calls have not been
+		d.run(true, simleg.RunOptions{Until: func(as simleg.Instruction) bool {
+			switch {
+			case isReturn(as):
+				depth++
+			case as.Op == "BL" && depth > 0:
+				depth--
+			}
+			if depth == 0 {
+				n--
+			}
+			return n == 0
+		}})
+	case "rc", "reverse-continue":
+		d.run(true, simleg.RunOptions{})
+	case "rf", "reverse-finish":
+		depth := 0
+		d.run(true, simleg.RunOptions{Until: func(as simleg.Instruction) bool {
+			switch {
+			case isReturn(as):
+				depth++
+			case as.Op == "BL":
+				if depth == 0 {
+					return true
+				}
+				depth--
+			}
+			return false
+		}})
+	case "last":
+		if len(args) != 1 {
+			return false, fmt.Errorf("usage: last addr")
+		}
+		addr, err := d.eval(args[0])
+		if err != nil {
+			return false, err
+		}
+		w, ok := d.cpu.LastWrite(addr)
+		if !ok {
+			return false, fmt.Errorf("no write to %#x recorded", addr)
+		}
+		as, _ := d.cpu.Instruction(w.PC)
+		as.Label = ""
+		fmt.Fprintf(d.out, "instruction %d wrote %s to %s, which held %s\n",
+			w.Step, hexBytes(w.New), d.describe(w.Addr), hexBytes(w.Old))
+		fmt.Fprintf(d.out, "%s: %s\n", d.describe(w.PC), as)
+		d.printLine(as.Pos)
+	case "b", "break":
+		if len(args) != 1 {
+			return false, fmt.Errorf("usage: break loc")
+		}
+		addr, err := d.locate(args[0])
+		if err != nil {
+			return false, err
+		}
+		for _, b := range d.breaks {
+			if b.watch == nil && b.addr == addr {
+				return false, fmt.Errorf("breakpoint %d is already at %#x", b.n, addr)
+			}
+		}
+		d.nbreaks++
+		d.breaks = append(d.breaks, breakpoint{n: d.nbreaks, addr: addr})
+		fmt.Fprintf(d.out, "breakpoint %d at %s\n", d.nbreaks, d.describe(addr))
+	case "watch", "rwatch", "awatch":
+		if len(args) < 1 || len(args) > 2 {
+			return false, fmt.Errorf("usage: %s addr [n]", name)
+		}
+		w := &simleg.Watchpoint{Size: 8, Kind: simleg.AccessWrite}
+		switch name {
+		case "rwatch":
+			w.Kind = simleg.AccessRead
+		case "awatch":
+			w.Kind = simleg.AccessRead | simleg.AccessWrite
+		}
+		if w.Addr, err = d.eval(args[0]); err != nil {
+			return false, err
+		}
+		if len(args) > 1 {
+			if w.Size, err = strconv.ParseUint(args[1], 0, 64); err != nil || w.Size == 0 {
+				return false, fmt.Errorf("bad size %s", args[1])
+			}
+		}
+		d.nbreaks++
+		d.breaks = append(d.breaks, breakpoint{n: d.nbreaks, addr: w.Addr, watch: w})
+		fmt.Fprintf(d.out, "watchpoint %d: %s of %d bytes at %s\n", d.nbreaks, w.Kind, w.Size, d.describe(w.Addr))
+	case "d", "delete":
+		if len(args) == 0 {
+			d.breaks = nil
+			return false, nil
+		}
+		n, err := count()
+		if err != nil {
+			return false, err
+		}
+		for i, b := range d.breaks {
+			if b.n == n {
+				d.breaks = append(d.breaks[:i], d.breaks[i+1:]...)
+				return false, nil
+			}
+		}
+		return false, fmt.Errorf("no breakpoint %d", n)
+	case "i", "info":
+		if len(args) != 1 {
+			return false, fmt.Errorf("usage: info breakpoints|registers")
+		}
+		switch args[0] {
+		case "b", "break", "breakpoints":
+			d.infoBreakpoints()
+		case "r", "reg", "registers":
+			d.infoRegisters()
+		default:
+			return false, fmt.Errorf("unknown info %s", args[0])
+		}
+	case "p", "print":
+		if len(args) == 0 {
+			return false, fmt.Errorf("usage: print expr")
+		}
+		return false, d.print(strings.Join(args, ""))
+	case "x":
+		if len(args) == 0 {
+			return false, fmt.Errorf("usage: x/nf addr")
+		}
+		return false, d.examine(spec, strings.Join(args, ""))
+	case "set":
+		return false, d.set(strings.Join(args, " "))
+	case "l", "list":
+		addr := d.cpu.PC
+		if len(args) > 0 {
+			if addr, err = d.locate(args[0]); err != nil {
+				return false, err
+			}
+		}
+		return false, d.list(addr)
+	case "r", "run":
+		if err := d.load(); err != nil {
+			return false, err
+		}
+		d.where()
+	case "h", "help":
+		fmt.Fprintln(d.out, debugHelp)
+	case "q", "quit":
+		return true, nil
+	default:
+		return false, fmt.Errorf(`unknown command %s, type "help" for a list`, name)
+	}
+	return false, nil
+}
+
+func isReturn(as simleg.Instruction) bool {
+	return as.Op == "BR" && as.To.Reg == simleg.LR
+}
+
+// run runs the program with opts and the breakpoints set, or undoes it if
+// reverse is true, until it stops or the user interrupts it.
+func (d *debugger) run(reverse bool, opts simleg.RunOptions) {
+	if d.exited && !reverse {
+		fmt.Fprintln(d.out, `the program has exited, use "run" to start it again`)
+		return
+	}
+	var breaks, watches []breakpoint
+	for _, b := range d.breaks {
+		if b.watch != nil {
+			opts.Watchpoints = append(opts.Watchpoints, *b.watch)
+			watches = append(watches, b)
+		} else {
+			opts.Breakpoints = append(opts.Breakpoints, simleg.Breakpoint{Addr: b.addr})
+			breaks = append(breaks, b)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-d.interrupt:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	run := d.cpu.Run
+	if reverse {
+		run = d.cpu.ReverseContinue
+	}
+	stop, err := run(ctx, opts)
+	if reverse && stop.Steps > 0 {
+		d.exited = false
+	}
+	switch stop.Reason {
+	case simleg.StopFault:
+		fmt.Fprintln(d.out, err)
+		return
+	case simleg.StopExited:
+		d.exited = true
+		fmt.Fprintf(d.out, "program exited with X0 = %d\n", d.cpu.Registers[simleg.X0])
+		return
+	case simleg.StopCanceled:
+		fmt.Fprintln(d.out, "interrupted")
+	case simleg.StopHistoryStart:
+		fmt.Fprintln(d.out, "reached the start of the recorded history")
+	case simleg.StopBreakpoint:
+		fmt.Fprintf(d.out, "breakpoint %d\n", breaks[stop.Breakpoint].n)
+	case simleg.StopWatchpoint:
+		a := stop.Access
+		fmt.Fprintf(d.out, "watchpoint %d: %s of %s at %s\n", watches[stop.Watchpoint].n,
+			a.Kind, hexBytes(a.Data), d.describe(a.Addr))
+	}
+	d.where()
+}
+
+// where prints the instruction at PC and the line of source it came from.
+func (d *debugger) where() {
+	if d.exited {
+		fmt.Fprintln(d.out, "the program has exited")
+		return
+	}
+	as, ok := d.cpu.Instruction(d.cpu.PC)
+	if !ok && d.cpu.Err == nil {
+		// stopped by a watchpoint after the last instruction
+		fmt.Fprintf(d.out, "%s: end of the program\n", d.describe(d.cpu.PC))
+		return
+	}
+	pos := as.Pos
+	as.Label = "" // describe shows it
+	fmt.Fprintf(d.out, "%s: %s\n", d.describe(d.cpu.PC), as)
+	d.printLine(pos)
+}
+
+// printLine prints the line of source at pos, if it can be read.
+func (d *debugger) printLine(pos simleg.Pos) {
+	if lines := d.source(pos.File); pos.Line >= 1 && pos.Line <= len(lines) {
+		fmt.Fprintf(d.out, "%d\t%s\n", pos.Line, lines[pos.Line-1])
+	}
+}
+
+// hexBytes formats little-endian bytes as a hexadecimal number.
+func hexBytes(b []byte) string {
+	var v [8]byte
+	copy(v[:], b)
+	return fmt.Sprintf("%#x", binary.LittleEndian.Uint64(v[:]))
+}
+
+// describe returns addr along with the label it is nearest after, if it
+// is in the program or its data.
+func (d *debugger) describe(addr uint64) string {
+	data := addr >= simleg.DataOffset
+	if _, ok := d.cpu.Instruction(addr &^ 3); !ok && !data {
+		return fmt.Sprintf("%#x", addr)
+	}
+	var best string
+	var at uint64
+	for name, a := range d.labels {
+		if a > addr || (a >= simleg.DataOffset) != data {
+			continue
+		}
+		if best == "" || a > at || a == at && name < best {
+			best, at = name, a
+		}
+	}
+	switch {
+	case best == "":
+		return fmt.Sprintf("%#x", addr)
+	case at == addr:
+		return fmt.Sprintf("%#x <%s>", addr, best)
+	}
+	return fmt.Sprintf("%#x <%s+%d>", addr, best, addr-at)
+}
+
+// source returns the lines of the file at path, or nil if it cannot be
+// read.
+func (d *debugger) source(path string) []string {
+	if path == "" {
+		return nil
+	}
+	lines, ok := d.sources[path]
+	if !ok {
+		if b, err := ioutil.ReadFile(path); err == nil {
+			lines = strings.Split(string(b), "\n")
+		}
+		d.sources[path] = lines
+	}
+	return lines
+}
+
+// list prints the lines of source around the one addr came from.
+func (d *debugger) list(addr uint64) error {
+	as, ok := d.cpu.Instruction(addr)
+	if !ok {
+		return fmt.Errorf("no instruction at %#x", addr)
+	}
+	lines := d.source(as.Pos.File)
+	if lines == nil {
+		return fmt.Errorf("no source for %#x", addr)
+	}
+	cur, _ := d.cpu.Instruction(d.cpu.PC)
+	for n := as.Pos.Line - 5; n < as.Pos.Line+5; n++ {
+		if n < 1 || n > len(lines) {
+			continue
+		}
+		mark := "  "
+		if !d.exited && cur.Pos.File == as.Pos.File && cur.Pos.Line == n {
+			mark = "=>"
+		}
+		fmt.Fprintf(d.out, "%s %d\t%s\n", mark, n, lines[n-1])
+	}
+	return nil
+}
+
+// locate returns the address of an instruction given by a label, a line
+// of source, file:line or *address. A line without code stands for the
+// next line that has some.
+func (d *debugger) locate(loc string) (uint64, error) {
+	if strings.HasPrefix(loc, "*") {
+		return d.eval(loc[1:])
+	}
+	if addr, ok := d.labels[loc]; ok {
+		return addr, nil
+	}
+	file, line := "", loc
+	if i := strings.LastIndex(loc, ":"); i >= 0 {
+		file, line = loc[:i], loc[i+1:]
+	}
+	n, err := strconv.Atoi(line)
+	if err != nil {
+		return 0, fmt.Errorf("no label '%s'", loc)
+	}
+	if file == "" {
+		cur, _ := d.cpu.Instruction(d.cpu.PC)
+		file = cur.Pos.File
+	}
+	return d.cpu.LineAddr(file, n)
+}
+
+// eval evaluates a sum of registers, labels and numbers.
+func (d *debugger) eval(s string) (uint64, error) {
+	s = strings.Replace(s, " ", "", -1)
+	if s == "" {
+		return 0, fmt.Errorf("missing address")
+	}
+	var sum uint64
+	for s != "" {
+		neg := false
+		if s[0] == '+' || s[0] == '-' {
+			neg = s[0] == '-'
+			s = s[1:]
+		}
+		end := strings.IndexAny(s, "+-")
+		if end < 0 {
+			end = len(s)
+		}
+		n, err := d.value(s[:end])
+		if err != nil {
+			return 0, err
+		}
+		if neg {
+			n = -n
+		}
+		sum += n
+		s = s[end:]
+	}
+	return sum, nil
+}
+
+// value returns the value of a general purpose register, PC, a label or
+// a number.
+func (d *debugger) value(t string) (uint64, error) {
+	if t == "" {
+		return 0, fmt.Errorf("missing operand")
+	}
+	if addr, ok := d.labels[t]; ok {
+		return addr, nil
+	}
+	if strings.ToUpper(t) == "PC" {
+		return d.cpu.PC, nil
+	}
+	if r, err := simleg.ParseRegister(strings.ToUpper(t)); err == nil {
+		if r > simleg.XZR {
+			return 0, fmt.Errorf("%s is not a general purpose register", r)
+		}
+		return d.cpu.Registers[r], nil
+	}
+	n, err := strconv.ParseUint(t, 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("no register or label '%s'", t)
+	}
+	return n, nil
+}
+
+func (d *debugger) print(expr string) error {
+	name := strings.ToUpper(expr)
+	if name == "FLAGS" || name == "NZCV" {
+		fmt.Fprintf(d.out, "flags = %s\n", d.cpu.Flags)
+		return nil
+	}
+	if r, err := simleg.ParseRegister(name); err == nil && r > simleg.XZR {
+		bits := d.cpu.FPRegisters[r.Num()]
+		if name[0] == 'S' {
+			fmt.Fprintf(d.out, "%s = %g\n", r, math.Float32frombits(uint32(bits)))
+		} else {
+			fmt.Fprintf(d.out, "%s = %g\n", r, math.Float64frombits(bits))
+		}
+		return nil
+	}
+	n, err := d.eval(expr)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(d.out, "%s = %d (%#x)\n", expr, int64(n), n)
+	return nil
+}
+
+func (d *debugger) infoRegisters() {
+	for r := simleg.X0; r <= simleg.LR; r++ {
+		v := d.cpu.Registers[r]
+		fmt.Fprintf(d.out, "%-4s %#-18x %d\n", r, v, int64(v))
+	}
+	fmt.Fprintf(d.out, "%-4s %s\n", "PC", d.describe(d.cpu.PC))
+	fmt.Fprintf(d.out, "%-4s %s\n", "NZCV", d.cpu.Flags)
+}
+
+func (d *debugger) infoBreakpoints() {
+	if len(d.breaks) == 0 {
+		fmt.Fprintln(d.out, "no breakpoints")
+		return
+	}
+	for _, b := range d.breaks {
+		if w := b.watch; w != nil {
+			fmt.Fprintf(d.out, "%d\t%s of %d bytes at %s\n", b.n, w.Kind, w.Size, d.describe(w.Addr))
+			continue
+		}
+		as, _ := d.cpu.Instruction(b.addr)
+		fmt.Fprintf(d.out, "%d\t%s\t%s:%d\n", b.n, d.describe(b.addr), as.Pos.File, as.Pos.Line)
+	}
+}
+
+// examine prints memory at the address expr in the format spec, a count
+// followed by a unit size.
+func (d *debugger) examine(spec, expr string) error {
+	n, size := 1, 8
+	if i := strings.IndexFunc(spec, func(r rune) bool { return r < '0' || r > '9' }); i != 0 {
+		if i < 0 {
+			i = len(spec)
+		}
+		var err error
+		if n, err = strconv.Atoi(spec[:i]); err != nil || n < 1 {
+			return fmt.Errorf("bad count in x/%s", spec)
+		}
+		spec = spec[i:]
+	}
+	switch spec {
+	case "b":
+		size = 1
+	case "h":
+		size = 2
+	case "w":
+		size = 4
+	case "g", "":
+	default:
+		return fmt.Errorf("unknown unit size %s, want b, h, w or g", spec)
+	}
+	addr, err := d.eval(expr)
+	if err != nil {
+		return err
+	}
+	perLine := 16 / size
+	for i := 0; i < n; i++ {
+		a := addr + uint64(i*size)
+		if i%perLine == 0 {
+			if i > 0 {
+				fmt.Fprintln(d.out)
+			}
+			fmt.Fprintf(d.out, "%s:", d.describe(a))
+		}
+		var b [8]byte
+		d.cpu.Memory.Read(b[:size], a)
+		fmt.Fprintf(d.out, " 0x%0*x", 2*size, binary.LittleEndian.Uint64(b[:]))
+	}
+	fmt.Fprintln(d.out)
+	return nil
+}
+
+// set parses "reg value" or "reg=value" and sets the register. Setting PC
+// or an X register clears a fault, so that the program can go on.
+func (d *debugger) set(s string) error {
+	f := strings.Fields(strings.Replace(s, "=", " ", 1))
+	if len(f) < 2 {
+		return fmt.Errorf("usage: set reg value")
+	}
+	name, val := strings.ToUpper(f[0]), strings.Join(f[1:], "")
+	if name == "PC" {
+		n, err := d.eval(val)
+		if err != nil {
+			return err
+		}
+		d.cpu.PC, d.cpu.Err = n, nil
+		d.where()
+		return nil
+	}
+	r, err := simleg.ParseRegister(name)
+	if err != nil {
+		return err
+	}
+	if r > simleg.XZR {
+		x, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return fmt.Errorf("bad number %s", val)
+		}
+		bits := math.Float64bits(x)
+		if name[0] == 'S' {
+			bits = uint64(math.Float32bits(float32(x)))
+		}
+		d.cpu.FPRegisters[r.Num()] = bits
+		return nil
+	}
+	if r == simleg.XZR {
+		return fmt.Errorf("XZR is always zero")
+	}
+	n, err := d.eval(val)
+	if err != nil {
+		return err
+	}
+	d.cpu.Registers[r], d.cpu.Err = n, nil
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sean-callahan/simleg"
+)
+
+const debugSource = `	ADDI X1,XZR,#5
+	BL double
+	LDA X9,value
+	STUR X1,[X9,#0]
+	BR X3
+	B end
+double:	ADD X1,X1,X1
+	BR LR
+done:	BR X4
+end:	ADDI X0,X1,#0
+	.data
+value:	.dword 1,2
+`
+
+// Each row is a command and what the debugger prints for it. FILE stands
+// for the path of debugSource.
+var debugTests = []struct {
+	cmd, out string
+}{
+	{"set X3 0", ""},
+	{"set X4=1", ""},
+	{"set S1 1.5", ""},
+	{"set D2=-0.25", ""},
+	{"p S1", "S1 = 1.5\n"},
+	{"p D2", "D2 = -0.25\n"},
+	{"break double", "breakpoint 1 at 0x40001c <double>\n"},
+	{"c", "breakpoint 1\n0x40001c <double>: ADD X1,X1,X1\n7\tdouble:\tADD X1,X1,X1\n"},
+	{"s", "0x400020 <double+4>: BR X30\n8\t\tBR LR\n"},
+	{"p X1", "X1 = 10 (0xa)\n"},
+	{"s 2", "0x40000c: MOVK X9,#4096,LSL #16\n3\t\tLDA X9,value\n"},
+	{"", "0x400014: BR X3\n5\t\tBR X3\n"},
+	{"x/2g value", "0x10000000 <value>: 0x000000000000000a 0x0000000000000002\n"},
+	{"s", "FILE:5:2: 0x400014: BR X3: bad branch target: 0x0\n"},
+	{"s", "FILE:5:2: 0x400014: BR X3: bad branch target: 0x0\n"},
+	{"set X3 done", ""},
+	{"s", "0x400024 <done>: BR X4\n9\tdone:\tBR X4\n"},
+	{"s", "FILE:9:1: 0x400024: done: BR X4: misaligned address: 0x1\n"},
+	{"set PC end", "0x400028 <end>: ADDI X0,X1,#0\n10\tend:\tADDI X0,X1,#0\n"},
+	{"s", "program exited with X0 = 10\n"},
+}
+
+func TestDebugger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "debug.asm")
+	if err := ioutil.WriteFile(path, []byte(debugSource), 0666); err != nil {
+		t.Fatal(err)
+	}
+	p := &simleg.Parser{}
+	prog, err := p.ParseFiles(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	d := &debugger{
+		prog:      prog,
+		out:       &out,
+		interrupt: make(chan os.Signal, 1),
+		sources:   make(map[string][]string),
+	}
+	if err := d.load(); err != nil {
+		t.Fatal(err)
+	}
+	var script strings.Builder
+	for _, tt := range debugTests {
+		script.WriteString(tt.cmd + "\n")
+	}
+	d.repl(strings.NewReader(script.String()))
+
+	// The output for each command follows its prompt.
+	outs := strings.Split(out.String(), "(simleg) ")
+	if len(outs) != len(debugTests)+2 {
+		t.Fatalf("%d prompts for %d commands:\n%s", len(outs)-1, len(debugTests), out.String())
+	}
+	for i, tt := range debugTests {
+		want := strings.Replace(tt.out, "FILE", path, -1)
+		if got := outs[i+1]; got != want {
+			t.Errorf("%q printed\n%s\nwant\n%s", tt.cmd, got, want)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"log"
+
+	"github.com/sean-callahan/simleg"
+)
+
+// disasm prints the instructions encoded in the binary file at path.
+func disasm(path string) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	prog, err := simleg.Disassemble(b)
+	for i, as := range prog {
+		w := binary.LittleEndian.Uint32(b[4*i:])
+		fmt.Printf("%-24s // %04x: %08x\n", as, 4*i, w)
+	}
+	if err != nil {
+		log.Fatalln("disasm:", err)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"os"
+
+	"github.com/sean-callahan/simleg"
+)
+
+// gdbserver loads a program and serves one GDB session for it on a TCP
+// address, as in "target remote :1234".
+func gdbserver(args []string) {
+	fs := flag.NewFlagSet(os.Args[0]+" gdbserver", flag.ExitOnError)
+	fs.Usage = usage
+	text := fs.Bool("text", false, "execute the program from the text segment in memory")
+	fs.Parse(args)
+	if fs.NArg() < 2 {
+		usage()
+	}
+
+	prog := readProgram(fs.Args()[1:])
+	cpu := &simleg.CPU{}
+	load := cpu.Load
+	if *text {
+		load = cpu.LoadText
+	}
+	if err := load(prog); err != nil {
+		fatal("load program", err)
+	}
+
+	l, err := net.Listen("tcp", fs.Arg(0))
+	if err != nil {
+		log.Fatalln("listen:", err)
+	}
+	log.Println("listening on", l.Addr())
+	conn, err := l.Accept()
+	l.Close()
+	if err != nil {
+		log.Fatalln("accept:", err)
+	}
+	defer conn.Close()
+	log.Println("debugging from", conn.RemoteAddr())
+	if err := simleg.ServeGDB(conn, cpu); err != nil {
+		log.Fatalln("gdb:", err)
+	}
+}
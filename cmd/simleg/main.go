@@ -1,46 +1,169 @@
 package main
 
 import (
+	"encoding/binary"
+	"errors"
+	"flag"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/sean-callahan/simleg"
 )
 
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [-text] [-cores n] [-x addr] path...\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s debug [-text] path...\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s gdbserver [-text] addr path...\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s dap\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s asm [-o file.o] file.asm\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s disasm file.bin\n", os.Args[0])
+	os.Exit(1)
+}
+
 func main() {
 	if len(os.Args) < 2 {
-		fmt.Fprintf(os.Stderr, "usage: %s path", os.Args[0])
-		os.Exit(1)
+		usage()
 	}
 
-	f, err := os.Open(os.Args[1])
-	if err != nil {
-		log.Fatal(err)
+	switch os.Args[1] {
+	case "asm":
+		asm(os.Args[2:])
+	case "debug":
+		debug(os.Args[2:])
+	case "dap":
+		dap(os.Args[2:])
+	case "gdbserver":
+		gdbserver(os.Args[2:])
+	case "disasm":
+		if len(os.Args) < 3 {
+			usage()
+		}
+		disasm(os.Args[2])
+	default:
+		run(os.Args[1:])
+	}
+}
+
+func run(args []string) {
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	fs.Usage = usage
+	text := fs.Bool("text", false, "execute the program from the text segment in memory")
+	cores := fs.Int("cores", 1, "number of cores sharing memory")
+	x := fs.String("x", "", "print the doubleword at `addr` when the program ends")
+	fs.Parse(args)
+	if fs.NArg() < 1 || *cores < 1 {
+		usage()
+	}
+	var addr uint64
+	if *x != "" {
+		var err error
+		if addr, err = strconv.ParseUint(*x, 0, 64); err != nil {
+			log.Fatalln("bad address", *x)
+		}
 	}
-	defer f.Close()
 
-	p := &simleg.Parser{}
-	p.Use(f)
+	prog := readProgram(fs.Args())
+
+	m := simleg.NewMachine(*cores)
+	load := m.Load
+	if *text {
+		load = m.LoadText
+	}
+	if err := load(prog); err != nil {
+		log.Fatalln("load program:", err)
+	}
 
-	var prog simleg.Program
 	for {
-		as, err := p.Next()
+		running, err := m.Step()
 		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			log.Fatalln("parse:", err)
+			fatal("run", err)
+		}
+		if !running {
+			break
 		}
-		prog = append(prog, as)
 	}
+	if *x != "" {
+		var b [8]byte
+		m.Memory.Read(b[:], addr)
+		fmt.Printf("%#x: %d\n", addr, binary.LittleEndian.Uint64(b[:]))
+	}
+}
 
-	cpu := &simleg.CPU{}
-	if err := cpu.Load(prog); err != nil {
-		log.Fatalln("load program:", err)
+// readProgram parses the source files at paths into a program, or links
+// them if there are object files among them, and exits on error.
+func readProgram(paths []string) simleg.Program {
+	prog, err := parseProgram(paths)
+	if err != nil {
+		if hasObject(paths) {
+			fatal("link", err)
+		}
+		fatal("parse", err)
 	}
+	return prog
+}
+
+// parseProgram is like readProgram, but returns any error.
+func parseProgram(paths []string) (simleg.Program, error) {
+	if hasObject(paths) {
+		return link(paths)
+	}
+	p := &simleg.Parser{}
+	return p.ParseFiles(paths...)
+}
 
-	for cpu.Step() {
+// hasObject reports whether any of paths is an object file, in which case
+// the program is linked from objects rather than parsed as one.
+func hasObject(paths []string) bool {
+	for _, path := range paths {
+		if strings.HasSuffix(path, ".o") {
+			return true
+		}
+	}
+	return false
+}
+
+// fatal prints err, or each error in a list, along with the source line
+// it refers to, then exits.
+func fatal(prefix string, err error) {
+	if list, ok := err.(simleg.ErrorList); ok {
+		for _, err := range list {
+			report(prefix, err)
+		}
+	} else {
+		report(prefix, err)
+	}
+	os.Exit(1)
+}
+
+func report(prefix string, err error) {
+	log.Println(prefix+":", err)
+	var pos simleg.Pos
+	var pe *simleg.ParseError
+	var ee *simleg.ExecError
+	switch {
+	case errors.As(err, &pe):
+		pos = pe.Pos
+	case errors.As(err, &ee):
+		pos = ee.Ins.Pos
+	}
+	if line := sourceLine(pos); line != "" {
+		fmt.Fprintf(os.Stderr, "\t%s\n", strings.TrimSpace(line))
+	}
+}
+
+// sourceLine returns the line of source that pos refers to.
+func sourceLine(pos simleg.Pos) string {
+	src, err := ioutil.ReadFile(pos.File)
+	if err != nil {
+		return ""
+	}
+	lines := strings.Split(string(src), "\n")
+	if pos.Line < 1 || pos.Line > len(lines) {
+		return ""
 	}
+	return lines[pos.Line-1]
 }
@@ -3,13 +3,17 @@ package simleg
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"math"
 	"math/bits"
 	"strings"
 )
 
 // Memory offsets
 const (
+	TextOffset  = 0x400000
 	StackOffset = 0x500000
+	DataOffset  = 0x10000000
 )
 
 type condFlag uint8
@@ -21,106 +25,254 @@ const (
 	flagC
 )
 
+// String returns the set flags as letters, such as "NC", or "-" if none
+// are set.
+func (f condFlag) String() string {
+	var sb strings.Builder
+	for i, c := range "NZCV" {
+		if f&[...]condFlag{flagN, flagZ, flagC, flagV}[i] != 0 {
+			sb.WriteRune(c)
+		}
+	}
+	if sb.Len() == 0 {
+		return "-"
+	}
+	return sb.String()
+}
+
 type CPU struct {
-	PC        uint64
-	Registers [32]uint64
-	Flags     condFlag
-	Err       error
+	PC          uint64
+	Registers   [32]uint64
+	FPRegisters [32]uint64 // S and D registers, as raw IEEE 754 bits
+	Flags       condFlag
+	Err         error
 
 	Memory *Memory
 
-	labels map[string]uint64
-	prog   []Instruction
+	labels   map[string]uint64
+	prog     []Instruction
+	textEnd  uint64 // address just past the last instruction
+	fetchMem bool   // fetch instructions from Memory instead of prog
+	history  *history
 }
 
+// Load prepares the CPU to run prog. Instructions are addressed as if they
+// were placed in the text segment, but are fetched from prog directly.
+// The data segment is written to Memory at DataOffset.
+// A new Memory is allocated unless cpu.Memory is already set.
 func (cpu *CPU) Load(prog Program) error {
-	cpu.Memory = &Memory{}
+	if cpu.Memory == nil {
+		cpu.Memory = &Memory{}
+	}
 
 	for i := 0; i < len(cpu.Registers); i++ {
 		cpu.Registers[i] = random.Uint64()
 	}
+	cpu.Registers[XZR] = 0
+	labels, text, data := prog.layout()
+	if _, err := cpu.Memory.Write(data, DataOffset); err != nil {
+		return err
+	}
+	cpu.labels = labels
+	cpu.prog = text
+	cpu.PC = TextOffset
+	cpu.textEnd = TextOffset + 4*uint64(len(text))
+	cpu.fetchMem = false
+	cpu.Err = nil
+	if cpu.history != nil {
+		cpu.history.reset()
+	}
 
-	cpu.labels = make(map[string]uint64)
-	cpu.prog = prog
-	for i, as := range prog {
-		if as.Label != "" {
-			cpu.labels[as.Label] = uint64(i)
-		}
+	cpu.Registers[SP] = StackOffset
+	cpu.Registers[LR] = cpu.textEnd // returning from the top level ends the program
+	return nil
+}
+
+// LoadText is like Load, but encodes prog into the text segment of Memory
+// and fetches each instruction from there, so programs can read and modify
+// their own code.
+func (cpu *CPU) LoadText(prog Program) error {
+	b, err := prog.Encode()
+	if err != nil {
+		return err
 	}
+	if err := cpu.Load(prog); err != nil {
+		return err
+	}
+	if _, err := cpu.Memory.Write(b, TextOffset); err != nil {
+		return err
+	}
+	cpu.fetchMem = true
 	return nil
 }
 
-// Step runs the instruction that PC points to.
-func (cpu *CPU) Step() bool {
-	if len(cpu.prog) == 0 {
-		return false
+// Instruction returns the loaded instruction at addr. Under LoadText it is
+// decoded from memory, so it shows any changes the program made to its
+// code, and only its label and position come from the parsed program. Op
+// is empty if the word at addr does not decode.
+func (cpu *CPU) Instruction(addr uint64) (Instruction, bool) {
+	if addr < TextOffset || addr >= cpu.textEnd || addr%4 != 0 {
+		return Instruction{}, false
+	}
+	parsed := cpu.prog[(addr-TextOffset)/4]
+	if !cpu.fetchMem {
+		return parsed, true
+	}
+	as, err := cpu.decodeText(addr)
+	if err != nil {
+		as = Instruction{}
+	}
+	as.Label, as.Pos = parsed.Label, parsed.Pos
+	return as, true
+}
+
+// Labels returns the address of each label of the loaded program.
+func (cpu *CPU) Labels() map[string]uint64 {
+	labels := make(map[string]uint64, len(cpu.labels))
+	for name, addr := range cpu.labels {
+		labels[name] = addr
+	}
+	return labels
+}
+
+// fetch returns the instruction that PC points to.
+func (cpu *CPU) fetch() (as Instruction, ok bool) {
+	if cpu.PC < TextOffset || cpu.PC >= cpu.textEnd {
+		return as, false
+	}
+	parsed := cpu.prog[(cpu.PC-TextOffset)/4]
+	if !cpu.fetchMem {
+		return parsed, true
+	}
+	as, err := cpu.decodeText(cpu.PC)
+	as.Label, as.Pos = parsed.Label, parsed.Pos
+	if err != nil {
+		cpu.fault(UnknownOpcode, as, err)
+		return as, false
+	}
+	return as, true
+}
+
+// decodeText decodes the instruction word at addr in memory.
+func (cpu *CPU) decodeText(addr uint64) (Instruction, error) {
+	var d [4]byte
+	cpu.Memory.Read(d[:], addr)
+	return Decode(binary.LittleEndian.Uint32(d[:]))
+}
+
+// fault records an ExecError for as, the instruction at PC, in cpu.Err.
+func (cpu *CPU) fault(kind ErrorKind, as Instruction, err error) {
+	cpu.Err = &ExecError{PC: cpu.PC, Ins: as, Kind: kind, Err: err}
+}
+
+// Step runs the instruction that PC points to and reports whether the
+// program is still running. A program stops when PC moves past its last
+// instruction. If the instruction cannot be executed, Step returns an
+// *ExecError, which is also kept in cpu.Err, and PC is left unchanged.
+func (cpu *CPU) Step() (bool, error) {
+	_, running, err := cpu.step()
+	return running, err
+}
+
+// step is like Step, but also returns the instruction it ran.
+func (cpu *CPU) step() (Instruction, bool, error) {
+	if cpu.Err != nil {
+		return Instruction{}, false, cpu.Err
+	}
+	as, ok := cpu.fetch()
+	if !ok {
+		return as, false, cpu.Err
+	}
+	pc := cpu.PC
+	var before registerState
+	if cpu.history != nil {
+		before = cpu.registerState()
 	}
-	as := cpu.prog[cpu.PC]
 	switch {
+	case cpu.float(as):
+		cpu.PC += 4
+		break
 	case cpu.arith(as):
-		cpu.PC++
+		cpu.PC += 4
 		break
 	case cpu.branch(as):
 		break
 	case cpu.memory(as):
-		cpu.PC++
+		cpu.PC += 4
 		break
+	default:
+		cpu.fault(UnknownOpcode, as, nil)
 	}
-	return cpu.PC < uint64(len(cpu.prog))
+	cpu.Registers[XZR] = 0 // writes to XZR are discarded
+	if cpu.Err != nil {
+		cpu.PC = pc
+		if cpu.history != nil {
+			cpu.history.writes = nil
+		}
+		return as, false, cpu.Err
+	}
+	if cpu.history != nil {
+		cpu.history.add(before, cpu)
+	}
+	return as, cpu.PC < cpu.textEnd, nil
 }
 
 func (cpu CPU) valuesFor(as Instruction) (dst Register, a, b uint64) {
 	switch {
-	case strings.HasSuffix(as.Op, "I"):
+	case strings.HasSuffix(as.Op, "I"), strings.HasSuffix(as.Op, "IS"),
+		as.Op == "LSL", as.Op == "LSR":
 		return as.To.Reg, cpu.Registers[as.From.Reg], as.Imm
 	default:
 		return as.To.Reg, cpu.Registers[as.From.Reg], cpu.Registers[as.Reg]
 	}
 }
 
-func (cpu *CPU) setFlags(as Instruction, carry uint64) {
+// setFlags recomputes all four condition flags from the result of a
+// flag-setting instruction. Other instructions leave the flags alone.
+func (cpu *CPU) setFlags(as Instruction, result uint64, carry, overflow bool) {
 	if !strings.HasSuffix(as.Op, "S") {
 		return
 	}
-	v := cpu.Registers[as.To.Reg]
-	switch {
-	case v == 0:
-		cpu.Flags |= flagZ
-		fallthrough
-	case v < 0:
+	cpu.Flags = 0
+	if int64(result) < 0 {
 		cpu.Flags |= flagN
-		fallthrough
-	case carry == 1:
+	}
+	if result == 0 {
+		cpu.Flags |= flagZ
+	}
+	if carry {
 		cpu.Flags |= flagC
-		return
-	default:
-		cpu.Flags = 0
+	}
+	if overflow {
+		cpu.Flags |= flagV
 	}
 }
 
 func (cpu *CPU) arith(as Instruction) bool {
-	var carry uint64
 	dst, x, y := cpu.valuesFor(as)
 	switch {
 	case strings.HasPrefix(as.Op, "ADD"):
-		cpu.Registers[dst], carry = bits.Add64(x, y, 0)
-		cpu.setFlags(as, carry)
+		r, carry := bits.Add64(x, y, 0)
+		cpu.Registers[dst] = r
+		// overflow if both operands have the same sign and the result does not
+		cpu.setFlags(as, r, carry == 1, int64((x^r)&(y^r)) < 0)
 		return true
 	case strings.HasPrefix(as.Op, "SUB"):
-		cpu.Registers[dst], carry = bits.Sub64(x, y, 0)
-		cpu.setFlags(as, carry)
+		r, borrow := bits.Sub64(x, y, 0)
+		cpu.Registers[dst] = r
+		// C is set when there is no borrow; overflow if the operands have
+		// different signs and the result's sign differs from x
+		cpu.setFlags(as, r, borrow == 0, int64((x^y)&(x^r)) < 0)
 		return true
 	case strings.HasPrefix(as.Op, "EOR"):
 		cpu.Registers[dst] = x ^ y
-		cpu.setFlags(as, 0)
 		return true
 	case strings.HasPrefix(as.Op, "ORR"):
 		cpu.Registers[dst] = x | y
-		cpu.setFlags(as, 0)
 		return true
 	case strings.HasPrefix(as.Op, "AND"):
 		cpu.Registers[dst] = x & y
-		cpu.setFlags(as, 0)
+		cpu.setFlags(as, x&y, false, false)
 		return true
 	case as.Op == "LSL":
 		cpu.Registers[dst] = x << y
@@ -131,101 +283,295 @@ func (cpu *CPU) arith(as Instruction) bool {
 	case as.Op == "MUL":
 		cpu.Registers[dst] = x * y
 		return true
+	case as.Op == "SDIV":
+		// division by zero yields zero, as on ARMv8
+		if y == 0 {
+			cpu.Registers[dst] = 0
+			return true
+		}
+		cpu.Registers[dst] = uint64(int64(x) / int64(y))
+		return true
+	case as.Op == "UDIV":
+		if y == 0 {
+			cpu.Registers[dst] = 0
+			return true
+		}
+		cpu.Registers[dst] = x / y
+		return true
+	case as.Op == "SMULH":
+		hi, _ := bits.Mul64(x, y)
+		// correct the unsigned product for negative operands
+		if int64(x) < 0 {
+			hi -= y
+		}
+		if int64(y) < 0 {
+			hi -= x
+		}
+		cpu.Registers[dst] = hi
+		return true
+	case as.Op == "UMULH":
+		cpu.Registers[dst], _ = bits.Mul64(x, y)
+		return true
+	case as.Op == "MOVZ":
+		cpu.Registers[dst] = as.Imm << as.Shift
+		return true
+	case as.Op == "MOVK":
+		cpu.Registers[dst] = cpu.Registers[dst]&^(0xFFFF<<as.Shift) | as.Imm<<as.Shift
+		return true
 	default:
 		return false
 	}
 }
 
 func (cpu CPU) shouldBranch(cond string) (bool, error) {
-	val := func(f condFlag) condFlag { return cpu.Flags & f }
+	n := cpu.Flags&flagN != 0
+	z := cpu.Flags&flagZ != 0
+	c := cpu.Flags&flagC != 0
+	v := cpu.Flags&flagV != 0
 	switch cond {
 	case "EQ":
-		return val(flagZ) == 1, nil
+		return z, nil
 	case "NE":
-		return val(flagZ) == 0, nil
-	case "LT":
-		return val(flagN) != val(flagV), nil
-	case "LE":
-		return !(val(flagZ) == 0 && val(flagN) == val(flagV)), nil
-	case "GT":
-		return val(flagZ) == 0 && val(flagN) == val(flagV), nil
-	case "GE":
-		return val(flagN) == val(flagV), nil
+		return !z, nil
+	case "HS":
+		return c, nil
 	case "LO":
-		return val(flagC) == 0, nil
-	case "LS":
-		return !(val(flagZ) == 0 && val(flagC) == 1), nil
+		return !c, nil
+	case "MI":
+		return n, nil
+	case "PL":
+		return !n, nil
+	case "VS":
+		return v, nil
+	case "VC":
+		return !v, nil
 	case "HI":
-		return val(flagZ) == 0 && val(flagC) == 1, nil
-	case "HS":
-		return val(flagC) == 1, nil
+		return c && !z, nil
+	case "LS":
+		return !(c && !z), nil
+	case "GE":
+		return n == v, nil
+	case "LT":
+		return n != v, nil
+	case "GT":
+		return !z && n == v, nil
+	case "LE":
+		return !(!z && n == v), nil
 	default:
 		return false, errors.New("unknown comparison")
 	}
 }
 
+// jump sets PC to target, faulting if it is not the address of an
+// instruction or the end of the program.
+func (cpu *CPU) jump(as Instruction, target uint64) {
+	switch {
+	case target%4 != 0:
+		cpu.fault(Misaligned, as, fmt.Errorf("%#x", target))
+	case target < TextOffset || target > cpu.textEnd:
+		cpu.fault(BadBranchTarget, as, fmt.Errorf("%#x", target))
+	default:
+		cpu.PC = target
+	}
+}
+
 func (cpu *CPU) branch(as Instruction) bool {
-	addr := func(to Addr) uint64 {
-		if to.Label != "" {
-			return cpu.labels[to.Label]
+	jump := func(to Addr) {
+		if to.Label == "" {
+			cpu.jump(as, cpu.PC+uint64(4*to.Offset))
+			return
+		}
+		target, ok := cpu.labels[to.Label]
+		if !ok {
+			cpu.fault(UndefinedLabel, as, fmt.Errorf("'%s'", to.Label))
+			return
 		}
-		return cpu.PC + to.Offset
+		cpu.jump(as, target)
 	}
 	switch {
 	case as.Op == "B":
-		cpu.PC = addr(as.To)
+		jump(as.To)
+		return true
 	case as.Op == "BR":
-		cpu.PC = cpu.Registers[as.To.Reg]
+		cpu.jump(as, cpu.Registers[as.To.Reg])
 		return true
 	case as.Op == "BL":
-		cpu.Registers[LR] = uint64(cpu.PC)
-		cpu.PC = addr(as.To)
+		ret := cpu.PC + 4
+		jump(as.To)
+		if cpu.Err == nil {
+			cpu.Registers[LR] = ret
+		}
 		return true
 	case as.Op == "CBZ":
-		if cpu.Registers[as.To.Reg] != 0 {
-			cpu.PC++
+		if cpu.Registers[as.From.Reg] != 0 {
+			cpu.PC += 4
 			return true
 		}
-		cpu.PC = addr(as.From)
+		jump(as.To)
 		return true
 	case as.Op == "CBNZ":
-		if cpu.Registers[as.To.Reg] == 0 {
-			cpu.PC++
+		if cpu.Registers[as.From.Reg] == 0 {
+			cpu.PC += 4
 			return true
 		}
-		cpu.PC = addr(as.From)
+		jump(as.To)
 		return true
 	case strings.HasPrefix(as.Op, "B."):
 		cond := as.Op[len("B."):]
 		ok, err := cpu.shouldBranch(cond)
 		if err != nil {
-			panic(err)
+			cpu.fault(UnknownOpcode, as, err)
+			return true
 		}
 		if !ok {
-			cpu.PC++
+			cpu.PC += 4
 			return true
 		}
-		cpu.PC = addr(as.To)
+		jump(as.To)
 		return true
 	default:
 		return false
 	}
-	return false
+}
+
+// accessSize returns the number of bytes moved by a load or store.
+func accessSize(op string) int {
+	switch op[len(op)-1] {
+	case 'B':
+		return 1
+	case 'H':
+		return 2
+	case 'W':
+		return 4
+	}
+	return 8
+}
+
+// load reads a little-endian value of size bytes, zero-extended.
+func (cpu *CPU) load(addr uint64, size int) uint64 {
+	var d [8]byte
+	cpu.Memory.Read(d[:size], addr)
+	cpu.Memory.notify(Access{cpu, AccessRead, addr, d[:size]})
+	return binary.LittleEndian.Uint64(d[:])
+}
+
+// store writes the low size bytes of v in little-endian order.
+func (cpu *CPU) store(addr, v uint64, size int) {
+	var d [8]byte
+	binary.LittleEndian.PutUint64(d[:], v)
+	cpu.Memory.notify(Access{cpu, AccessWrite, addr, d[:size]})
+	cpu.Memory.Write(d[:size], addr)
 }
 
 func (cpu *CPU) memory(as Instruction) bool {
-	switch {
-	case as.Op == "STUR":
+	addr := cpu.Registers[as.From.Reg] + uint64(as.From.Offset)
+	switch as.Op {
+	case "STUR", "STURB", "STURH", "STURW":
+		cpu.store(addr, cpu.Registers[as.To.Reg], accessSize(as.Op))
+		return true
+	case "LDUR", "LDURB", "LDURH":
+		cpu.Registers[as.To.Reg] = cpu.load(addr, accessSize(as.Op))
+		return true
+	case "LDURSW":
+		cpu.Registers[as.To.Reg] = uint64(int32(cpu.load(addr, 4)))
+		return true
+	case "LDXR":
+		if addr%8 != 0 {
+			cpu.fault(Misaligned, as, fmt.Errorf("%#x", addr))
+			return true
+		}
 		var d [8]byte
-		binary.LittleEndian.PutUint64(d[:], cpu.Registers[as.To.Reg])
-		cpu.Memory.Write(d[:], cpu.Registers[as.From.Reg]+as.From.Offset)
+		cpu.Memory.loadExclusive(cpu, d[:], addr)
+		cpu.Registers[as.To.Reg] = binary.LittleEndian.Uint64(d[:])
 		return true
-	case as.Op == "LDUR":
+	case "STXR":
+		if addr%8 != 0 {
+			cpu.fault(Misaligned, as, fmt.Errorf("%#x", addr))
+			return true
+		}
 		var d [8]byte
-		cpu.Memory.Read(d[:], cpu.Registers[as.From.Reg]+as.From.Offset)
-		v := binary.LittleEndian.Uint64(d[:])
-		cpu.Registers[as.To.Reg] = v
+		binary.LittleEndian.PutUint64(d[:], cpu.Registers[as.To.Reg])
+		if ok, _ := cpu.Memory.storeExclusive(cpu, d[:], addr); ok {
+			cpu.Registers[as.Reg] = 0
+		} else {
+			cpu.Registers[as.Reg] = 1
+		}
+		return true
+	case "STURS":
+		cpu.store(addr, cpu.FPRegisters[as.To.Reg.Num()], 4)
+		return true
+	case "STURD":
+		cpu.store(addr, cpu.FPRegisters[as.To.Reg.Num()], 8)
+		return true
+	case "LDURS":
+		cpu.FPRegisters[as.To.Reg.Num()] = cpu.load(addr, 4)
+		return true
+	case "LDURD":
+		cpu.FPRegisters[as.To.Reg.Num()] = cpu.load(addr, 8)
 		return true
 	}
 	return false
 }
+
+// compareFlags sets NZCV from comparing x and y, as FCMP does.
+func (cpu *CPU) compareFlags(x, y float64) {
+	switch {
+	case x < y:
+		cpu.Flags = flagN
+	case x > y:
+		cpu.Flags = flagC
+	case x == y:
+		cpu.Flags = flagZ | flagC
+	default: // unordered
+		cpu.Flags = flagC | flagV
+	}
+}
+
+func (cpu *CPU) float(as Instruction) bool {
+	if !strings.HasPrefix(as.Op, "F") {
+		return false
+	}
+	op := as.Op[:len(as.Op)-1]
+	if as.registerPrefix() == 'S' {
+		x := math.Float32frombits(uint32(cpu.FPRegisters[as.From.Reg.Num()]))
+		y := math.Float32frombits(uint32(cpu.FPRegisters[as.Reg.Num()]))
+		var r float32
+		switch op {
+		case "FADD":
+			r = x + y
+		case "FSUB":
+			r = x - y
+		case "FMUL":
+			r = x * y
+		case "FDIV":
+			r = x / y
+		case "FCMP":
+			cpu.compareFlags(float64(x), float64(y))
+			return true
+		default:
+			return false
+		}
+		cpu.FPRegisters[as.To.Reg.Num()] = uint64(math.Float32bits(r))
+		return true
+	}
+	x := math.Float64frombits(cpu.FPRegisters[as.From.Reg.Num()])
+	y := math.Float64frombits(cpu.FPRegisters[as.Reg.Num()])
+	var r float64
+	switch op {
+	case "FADD":
+		r = x + y
+	case "FSUB":
+		r = x - y
+	case "FMUL":
+		r = x * y
+	case "FDIV":
+		r = x / y
+	case "FCMP":
+		cpu.compareFlags(x, y)
+		return true
+	default:
+		return false
+	}
+	cpu.FPRegisters[as.To.Reg.Num()] = math.Float64bits(r)
+	return true
+}
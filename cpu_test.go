@@ -0,0 +1,198 @@
+package simleg
+
+import (
+	"encoding/binary"
+	"math"
+	"strings"
+	"testing"
+)
+
+var conditions = []string{"EQ", "NE", "HS", "LO", "MI", "PL", "VS", "VC", "HI", "LS", "GE", "LT", "GT", "LE"}
+
+// Each row sets the flags with op X1,X2 (or op X1,#y), then expects the
+// conditions in taken to branch and the others not to.
+var flagTests = []struct {
+	op    string
+	x, y  uint64
+	flags string
+	taken string
+}{
+	{"SUBS", 1, 1, "ZC", "EQ HS PL VC LS GE LE"},
+	{"SUBS", 2, 1, "C", "NE HS PL VC HI GE GT"},
+	{"SUBS", 1, 2, "N", "NE LO MI VC LS LT LE"},
+	{"SUBS", 0, 0, "ZC", "EQ HS PL VC LS GE LE"},
+	// INT64_MIN - 1 overflows to INT64_MAX without a borrow
+	{"SUBS", 1 << 63, 1, "CV", "NE HS PL VS HI LT LE"},
+	{"SUBIS", 1 << 63, 1, "CV", "NE HS PL VS HI LT LE"},
+	// INT64_MAX - -1 overflows to INT64_MIN, borrowing
+	{"SUBS", math.MaxInt64, math.MaxUint64, "NV", "NE LO MI VS LS GE GT"},
+	{"ADDS", 1, 2, "-", "NE LO PL VC LS GE GT"},
+	// MAX_UINT64 + 1 carries out, leaving 0
+	{"ADDS", math.MaxUint64, 1, "ZC", "EQ HS PL VC LS GE LE"},
+	{"ADDIS", math.MaxUint64, 1, "ZC", "EQ HS PL VC LS GE LE"},
+	// INT64_MAX + 1 overflows to INT64_MIN
+	{"ADDS", math.MaxInt64, 1, "NV", "NE LO MI VS LS GE GT"},
+	{"ADDS", 1 << 63, 1 << 63, "ZCV", "EQ HS PL VS LS LT LE"},
+	{"ANDS", math.MaxUint64, 1 << 63, "N", "NE LO MI VC LS LT LE"},
+	{"ANDIS", 0xF0, 0x0F, "Z", "EQ LO PL VC LS GE LE"},
+}
+
+func TestFlags(t *testing.T) {
+	for _, tt := range flagTests {
+		var cpu CPU
+		cpu.Registers[X1] = tt.x
+		as := Instruction{Op: tt.op, To: Addr{Reg: X0}, From: Addr{Reg: X1}, Reg: X2}
+		if strings.HasSuffix(tt.op, "IS") {
+			as.Imm = tt.y
+		} else {
+			cpu.Registers[X2] = tt.y
+		}
+		if !cpu.arith(as) {
+			t.Fatalf("%s not run", tt.op)
+		}
+		if got := cpu.Flags.String(); got != tt.flags {
+			t.Errorf("%s %#x,%#x: flags %s, want %s", tt.op, tt.x, tt.y, got, tt.flags)
+		}
+		taken := strings.Fields(tt.taken)
+		for _, cond := range conditions {
+			want := false
+			for _, c := range taken {
+				want = want || c == cond
+			}
+			got, err := cpu.shouldBranch(cond)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("%s %#x,%#x: B.%s taken = %v, want %v", tt.op, tt.x, tt.y, cond, got, want)
+			}
+		}
+	}
+}
+
+func TestFlagsUnchanged(t *testing.T) {
+	var cpu CPU
+	cpu.Flags = flagZ | flagC
+	cpu.Registers[X1] = math.MaxUint64
+	cpu.Registers[X2] = 1
+	cpu.arith(Instruction{Op: "ADD", To: Addr{Reg: X0}, From: Addr{Reg: X1}, Reg: X2})
+	if got := cpu.Flags.String(); got != "ZC" {
+		t.Errorf("ADD changed the flags to %s", got)
+	}
+	if _, err := cpu.shouldBranch("AL"); err == nil {
+		t.Error("B.AL accepted")
+	}
+}
+
+var divideTests = []struct {
+	op   string
+	x, y uint64
+	want uint64
+}{
+	{"UDIV", 7, 2, 3},
+	{"UDIV", math.MaxUint64, 2, math.MaxInt64},
+	{"UDIV", 7, 0, 0},
+	{"SDIV", 7, 2, 3},
+	{"SDIV", neg(7), 2, neg(3)},
+	{"SDIV", 7, neg(2), neg(3)},
+	{"SDIV", 7, 0, 0},
+	{"SDIV", 1 << 63, 0, 0},
+	// the quotient, 2^63, wraps around to INT64_MIN
+	{"SDIV", 1 << 63, neg(1), 1 << 63},
+	{"SDIV", 1 << 63, 1, 1 << 63},
+	{"UMULH", math.MaxUint64, math.MaxUint64, math.MaxUint64 - 1},
+	{"UMULH", 1 << 63, 2, 1},
+	{"UMULH", 3, 5, 0},
+	// SMULH corrects the unsigned product for each negative operand
+	{"SMULH", neg(1), 1, math.MaxUint64},
+	{"SMULH", neg(3), 5, math.MaxUint64},
+	{"SMULH", 5, neg(3), math.MaxUint64},
+	{"SMULH", neg(1), neg(1), 0},
+	{"SMULH", 1 << 63, 1 << 63, 1 << 62},
+	{"SMULH", 1 << 63, 1, math.MaxUint64},
+	{"SMULH", math.MaxInt64, math.MaxInt64, 1<<62 - 1},
+	{"SMULH", 1 << 62, 4, 1},
+}
+
+func TestDivide(t *testing.T) {
+	for _, tt := range divideTests {
+		var cpu CPU
+		cpu.Registers[X1], cpu.Registers[X2] = tt.x, tt.y
+		if !cpu.arith(Instruction{Op: tt.op, To: Addr{Reg: X0}, From: Addr{Reg: X1}, Reg: X2}) {
+			t.Fatalf("%s not run", tt.op)
+		}
+		if got := cpu.Registers[X0]; got != tt.want {
+			t.Errorf("%s %#x,%#x = %#x, want %#x", tt.op, tt.x, tt.y, got, tt.want)
+		}
+	}
+}
+
+// Loads read the bytes 81 82 ... 88; stores write 0x1122334455667788 over
+// bytes that are all FF, and the doubleword there is read back.
+var loadStoreTests = []struct {
+	op   string
+	want uint64
+}{
+	{"LDUR", 0x8887868584838281},
+	{"LDURB", 0x81},
+	{"LDURH", 0x8281},
+	{"LDURSW", 0xFFFFFFFF84838281},
+	{"STUR", 0x1122334455667788},
+	{"STURB", 0xFFFFFFFFFFFFFF88},
+	{"STURH", 0xFFFFFFFFFFFF7788},
+	{"STURW", 0xFFFFFFFF55667788},
+}
+
+func TestLoadStore(t *testing.T) {
+	const addr = 0x600000
+	for _, tt := range loadStoreTests {
+		cpu := CPU{Memory: &Memory{}}
+		cpu.Registers[X1] = addr - 8
+		cpu.Registers[X2] = 0x1122334455667788
+		if strings.HasPrefix(tt.op, "LD") {
+			cpu.Memory.Write([]byte{0x81, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88}, addr)
+		} else {
+			cpu.Memory.Write([]byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}, addr)
+		}
+		if !cpu.memory(Instruction{Op: tt.op, To: Addr{Reg: X2}, From: Addr{Reg: X1, Offset: 8}}) {
+			t.Fatalf("%s not run", tt.op)
+		}
+		got := cpu.Registers[X2]
+		if strings.HasPrefix(tt.op, "ST") {
+			got = cpu.load(addr, 8)
+		}
+		if got != tt.want {
+			t.Errorf("%s = %#x, want %#x", tt.op, got, tt.want)
+		}
+	}
+}
+
+// neg returns the two's complement of n.
+func neg(n uint64) uint64 {
+	return -n
+}
+
+func TestInstructionLoadText(t *testing.T) {
+	var cpu CPU
+	if err := cpu.LoadText(parse(t, "ADDI X1,X1,#1\nend: SUBI X2,X2,#2")); err != nil {
+		t.Fatal(err)
+	}
+	w, err := Instruction{Op: "ADDI", To: Addr{Reg: X3}, From: Addr{Reg: X3}, Imm: 7}.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], w)
+	cpu.Memory.Write(b[:], TextOffset+4)
+	as, ok := cpu.Instruction(TextOffset + 4)
+	if !ok {
+		t.Fatal("no instruction at end")
+	}
+	if as.String() != "end: ADDI X3,X3,#7" || as.Pos.Line != 2 {
+		t.Errorf("Instruction = %s at %v, want the patched end: ADDI X3,X3,#7", as, as.Pos)
+	}
+	cpu.Memory.Write([]byte{0, 0, 0, 0}, TextOffset)
+	if as, ok := cpu.Instruction(TextOffset); !ok || as.Op != "" || as.Pos.Line != 1 {
+		t.Errorf("Instruction = %s at %v, %v for an invalid word", as, as.Pos, ok)
+	}
+}
@@ -0,0 +1,163 @@
+package simleg
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+type formatDecoder func(as *Instruction, w uint32)
+
+// opBits returns the width of op's opcode field.
+func opBits(op string) uint {
+	switch op {
+	case "B", "BL":
+		return 6
+	case "CBZ", "CBNZ":
+		return 8
+	case "MOVZ", "MOVK":
+		return 9
+	case "ADDI", "ADDIS", "ANDI", "ANDIS", "EORI", "ORRI", "SUBI", "SUBIS":
+		return 10
+	}
+	return 11
+}
+
+type decodeKey struct {
+	bits uint
+	op   uint32
+}
+
+// decodeOps maps opcode fields back to mnemonics. Some R-format
+// instructions share an opcode and are told apart by shamt.
+var decodeOps = make(map[decodeKey][]string)
+
+// opWidths lists the opcode widths in the order Decode tries them.
+var opWidths = []uint{11, 10, 9, 8, 6}
+
+func init() {
+	for name, m := range machineOps {
+		k := decodeKey{opBits(name), m.op}
+		decodeOps[k] = append(decodeOps[k], name)
+	}
+}
+
+// Decode returns the instruction encoded by w. Branch targets are decoded
+// as PC-relative offsets.
+func Decode(w uint32) (as Instruction, err error) {
+	if w>>24 == bcondOp {
+		for cond, c := range condCodes {
+			if w&0x1F == c {
+				as.Op = "B." + cond
+				bformatDecoder(&as, w)
+				return as, nil
+			}
+		}
+		return as, fmt.Errorf("unknown condition %#x", w&0x1F)
+	}
+	for _, n := range opWidths {
+		names := decodeOps[decodeKey{n, w >> (32 - n)}]
+		for _, name := range names {
+			if len(names) > 1 && machineOps[name].shamt != w>>10&0x3F {
+				continue
+			}
+			as.Op = name
+			f := opcodes[name]
+			if f.d == nil {
+				return as, fmt.Errorf("opcode: %s has no decoding", name)
+			}
+			f.d(&as, w)
+			return as, nil
+		}
+	}
+	return as, fmt.Errorf("unknown instruction %08x", w)
+}
+
+// Disassemble decodes little-endian machine code into a Program.
+func Disassemble(b []byte) (Program, error) {
+	if len(b)%4 != 0 {
+		return nil, fmt.Errorf("length %d is not a multiple of 4", len(b))
+	}
+	prog := make(Program, len(b)/4)
+	for i := range prog {
+		var err error
+		prog[i], err = Decode(binary.LittleEndian.Uint32(b[4*i:]))
+		if err != nil {
+			return prog[:i], fmt.Errorf("%04x: %v", 4*i, err)
+		}
+	}
+	return prog, nil
+}
+
+// register returns the register numbered n in the bank selected by prefix.
+func register(n uint32, prefix rune) Register {
+	switch prefix {
+	case 'S':
+		return S0 + Register(n)
+	case 'D':
+		return D0 + Register(n)
+	}
+	return Register(n)
+}
+
+// signExtend interprets the low n bits of v as a two's complement value.
+func signExtend(v uint32, n uint) int64 {
+	return int64(v) << (64 - n) >> (64 - n)
+}
+
+func rformatDecoder(as *Instruction, w uint32) {
+	as.To.Reg = register(w&0x1F, as.registerPrefix())
+	as.From.Reg = register(w>>5&0x1F, as.registerPrefix())
+	as.Reg = register(w>>16&0x1F, as.registerPrefix())
+}
+
+func fcformatDecoder(as *Instruction, w uint32) {
+	as.From.Reg = register(w>>5&0x1F, as.registerPrefix())
+	as.Reg = register(w>>16&0x1F, as.registerPrefix())
+}
+
+func iformatDecoder(as *Instruction, w uint32) {
+	as.To.Reg = register(w&0x1F, as.registerPrefix())
+	as.From.Reg = register(w>>5&0x1F, as.registerPrefix())
+	as.Imm = uint64(w >> 10 & 0xFFF)
+}
+
+func shformatDecoder(as *Instruction, w uint32) {
+	as.To.Reg = register(w&0x1F, as.registerPrefix())
+	as.From.Reg = register(w>>5&0x1F, as.registerPrefix())
+	as.Imm = uint64(w >> 10 & 0x3F)
+}
+
+func dformatDecoder(as *Instruction, w uint32) {
+	as.To.Reg = register(w&0x1F, as.registerPrefix())
+	as.From.Reg = register(w>>5&0x1F, 'X')
+	as.From.Offset = signExtend(w>>12&0x1FF, 9)
+}
+
+func xformatDecoder(as *Instruction, w uint32) {
+	as.To.Reg = register(w&0x1F, 'X')
+	as.From.Reg = register(w>>5&0x1F, 'X')
+	as.Reg = register(w>>16&0x1F, 'X')
+}
+
+func bformatDecoder(as *Instruction, w uint32) {
+	switch {
+	case as.Op == "BR":
+		as.To.Reg = register(w>>5&0x1F, 'X')
+	case strings.HasPrefix(as.Op, "B."):
+		as.To.Offset = signExtend(w>>5&0x7FFFF, 19)
+	default:
+		as.To.Offset = signExtend(w&0x3FFFFFF, 26)
+	}
+}
+
+func cbformatDecoder(as *Instruction, w uint32) {
+	as.From.Reg = register(w&0x1F, 'X')
+	as.To.Offset = signExtend(w>>5&0x7FFFF, 19)
+}
+
+func iwformatDecoder(as *Instruction, w uint32) {
+	as.To.Reg = register(w&0x1F, 'X')
+	as.Imm = uint64(w >> 5 & 0xFFFF)
+	as.Shift = uint8(w>>21&0x3) * 16
+}
@@ -0,0 +1,106 @@
+package simleg
+
+import (
+	"strings"
+	"testing"
+)
+
+// parse parses src as a whole program.
+func parse(t *testing.T, src string) Program {
+	t.Helper()
+	p := &Parser{Filename: "test.asm"}
+	p.Use(strings.NewReader(src))
+	prog, err := p.ParseAll()
+	if err != nil {
+		t.Fatalf("parse %q: %v", src, err)
+	}
+	return prog
+}
+
+// roundTripSources returns instructions using op, in the form String
+// prints them, with the widest operands that op can take.
+func roundTripSources(op string) []string {
+	r := "X"
+	if prefix := (Instruction{Op: op}).registerPrefix(); prefix != 'X' {
+		r = string(prefix)
+	}
+	switch {
+	case op == "BR":
+		return []string{"BR X30", "BR X0"}
+	case op == "B", op == "BL":
+		return []string{op + " 0", op + " -1", op + " 33554431", op + " -33554432"}
+	case strings.HasPrefix(op, "B."):
+		return []string{op + " 1", op + " -1", op + " 262143", op + " -262144"}
+	case op == "CBZ", op == "CBNZ":
+		return []string{op + " X1,-1", op + " X30,262143", op + " X0,-262144"}
+	case op == "MOVZ", op == "MOVK":
+		return []string{op + " X1,#0", op + " X2,#65535,LSL #16", op + " X30,#1,LSL #48"}
+	case op == "LSL", op == "LSR":
+		return []string{op + " X1,X2,#0", op + " X30,X0,#63"}
+	case op == "STXR":
+		return []string{"STXR X1,X2,[X3,#0]", "STXR X30,X0,[X28,#0]"}
+	case op == "LDXR":
+		return []string{"LDXR X1,[X2,#0]", "LDXR X30,[X28,#0]"}
+	case strings.HasPrefix(op, "LDUR"), strings.HasPrefix(op, "STUR"):
+		return []string{op + " " + r + "1,[X2,#0]", op + " " + r + "30,[X28,#-256]", op + " " + r + "0,[X9,#255]"}
+	case op == "FCMPS", op == "FCMPD":
+		return []string{op + " " + r + "1," + r + "2", op + " " + r + "31," + r + "0"}
+	case strings.HasSuffix(op, "I"), strings.HasSuffix(op, "IS"):
+		return []string{op + " X1,X2,#0", op + " X30,X28,#4095"}
+	}
+	return []string{op + " " + r + "1," + r + "2," + r + "3", op + " " + r + "30," + r + "0," + r + "29"}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for op, f := range opcodes {
+		if f.e == nil {
+			continue
+		}
+		for _, src := range roundTripSources(op) {
+			prog := parse(t, src)
+			if len(prog) != 1 {
+				t.Errorf("%s: parsed %d instructions", src, len(prog))
+				continue
+			}
+			w, err := prog[0].Encode()
+			if err != nil {
+				t.Errorf("%s: encode: %v", src, err)
+				continue
+			}
+			as, err := Decode(w)
+			if err != nil {
+				t.Errorf("%s: decode %08x: %v", src, w, err)
+				continue
+			}
+			if got := as.String(); got != src {
+				t.Errorf("%s: encoded as %08x, decoded as %s", src, w, got)
+			}
+		}
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	prog := parse(t, `
+top:	SUBI X1,X1,#1
+	CBZ X1,end
+	B.NE top
+	BL top
+	B top
+end:	BR LR
+`)
+	b, err := prog.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Disassemble(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "SUBI X1,X1,#1\nCBZ X1,4\nB.NE -2\nBL -3\nB -4\nBR X30\n"
+	if s := got.String(); s != want {
+		t.Errorf("disassembled as\n%swant\n%s", s, want)
+	}
+	if _, err := Disassemble(b[:5]); err == nil {
+		t.Error("disassembled a partial instruction")
+	}
+}
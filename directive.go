@@ -0,0 +1,196 @@
+package simleg
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Assembler directives. Apart from .text and .data, which switch sections,
+// .equ and .set, which define symbols, and .global, they reserve bytes in
+// the data segment; the bytes are kept in Instruction.Data.
+var directives = map[string]insFormat{
+	".text":   {p: sectionParser},
+	".data":   {p: sectionParser},
+	".equ":    {p: equParser, s: equString},
+	".global": {p: globalParser, s: globalString},
+	".set":    {p: equParser, s: equString},
+	".byte":   {p: intsParser(1), s: intsString(1)},
+	".word":   {p: intsParser(4), s: intsString(4)},
+	".dword":  {p: intsParser(8), s: intsString(8)},
+	".ascii":  {p: stringParser(false), s: stringString(false)},
+	".asciz":  {p: stringParser(true), s: stringString(true)},
+	".space":  {p: spaceParser, s: spaceString},
+	".align":  {p: alignParser, s: alignString},
+}
+
+// lookupFormat returns the format of an opcode or directive.
+func lookupFormat(op string) (insFormat, bool) {
+	if f, ok := opcodes[op]; ok {
+		return f, true
+	}
+	f, ok := directives[op]
+	return f, ok
+}
+
+// isData reports whether op is a directive that reserves data.
+func isData(op string) bool {
+	switch op {
+	case ".text", ".data", ".equ", ".set", ".global":
+		return false
+	}
+	_, ok := directives[op]
+	return ok
+}
+
+func sectionParser(p *Parser, as *Instruction) error {
+	p.inData = as.Op == ".data"
+	return nil
+}
+
+// intsParser returns a parser for a list of integers of size bytes each.
+func intsParser(size int) formatParser {
+	return func(p *Parser, as *Instruction) error {
+		for {
+			off := len(as.Data)
+			as.Data = append(as.Data, make([]byte, size)...)
+			site := relocSite{off: off}
+			switch size {
+			case 4:
+				site.kind = RelocWord
+			case 8:
+				site.kind = RelocDword
+			}
+			err := p.expectAddress(as, "value", site, func(as *Instruction, n int64) error {
+				// accept both signed and unsigned values
+				if bits := uint(8 * size); bits < 64 && (n < -1<<(bits-1) || n >= 1<<bits) {
+					return fmt.Errorf("%d does not fit in %d bytes", n, size)
+				}
+				var d [8]byte
+				binary.LittleEndian.PutUint64(d[:], uint64(n))
+				copy(as.Data[off:], d[:size])
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if !p.has(itemComma) {
+				return nil
+			}
+			p.expect(itemComma)
+		}
+	}
+}
+
+func intsString(size int) func(w io.Writer, as Instruction) {
+	return func(w io.Writer, as Instruction) {
+		for i := 0; i+size <= len(as.Data); i += size {
+			var d [8]byte
+			copy(d[:], as.Data[i:i+size])
+			if i > 0 {
+				fmt.Fprint(w, ",")
+			}
+			fmt.Fprint(w, binary.LittleEndian.Uint64(d[:]))
+		}
+	}
+}
+
+// stringParser returns a parser for a list of strings, each terminated by
+// a NUL byte if nul is set.
+func stringParser(nul bool) formatParser {
+	return func(p *Parser, as *Instruction) error {
+		for {
+			t, err := p.expect(itemString)
+			if err != nil {
+				return err
+			}
+			s, err := strconv.Unquote(t)
+			if err != nil {
+				return fmt.Errorf("bad string %s", t)
+			}
+			as.Data = append(as.Data, s...)
+			if nul {
+				as.Data = append(as.Data, 0)
+			}
+			if !p.has(itemComma) {
+				return nil
+			}
+			p.expect(itemComma)
+		}
+	}
+}
+
+func stringString(nul bool) func(w io.Writer, as Instruction) {
+	return func(w io.Writer, as Instruction) {
+		d := as.Data
+		if nul && len(d) > 0 {
+			d = d[:len(d)-1]
+		}
+		fmt.Fprint(w, strconv.Quote(string(d)))
+	}
+}
+
+// equParser parses .equ and .set, which give a name to the value of an
+// expression. Only .set may redefine a name.
+func equParser(p *Parser, as *Instruction) (err error) {
+	as.To.Label, err = p.expect(itemName)
+	if err != nil {
+		return fmt.Errorf("name: %v", err)
+	}
+	if _, ok := p.scope.symbols[as.To.Label]; ok && as.Op == ".equ" {
+		return fmt.Errorf("%s redefined", as.To.Label)
+	}
+	if _, err = p.expect(itemComma); err != nil {
+		return err
+	}
+	return p.expectValue(as, "value", func(as *Instruction, n int64) error {
+		p.scope.symbols[as.To.Label] = n
+		as.Imm = uint64(n)
+		return nil
+	})
+}
+
+func equString(w io.Writer, as Instruction) {
+	fmt.Fprintf(w, "%s,%d", as.To.Label, int64(as.Imm))
+}
+
+// globalParser parses .global, which makes a label visible to the other
+// files of a program.
+func globalParser(p *Parser, as *Instruction) (err error) {
+	as.To.Label, err = p.expect(itemName)
+	if err != nil {
+		return fmt.Errorf("name: %v", err)
+	}
+	return nil
+}
+
+func globalString(w io.Writer, as Instruction) {
+	fmt.Fprint(w, as.To.Label)
+}
+
+func spaceParser(p *Parser, as *Instruction) error {
+	n, err := p.expectImmediate(20)
+	if err != nil {
+		return fmt.Errorf("size: %v", err)
+	}
+	as.Data = make([]byte, n)
+	return nil
+}
+
+func spaceString(w io.Writer, as Instruction) {
+	fmt.Fprint(w, len(as.Data))
+}
+
+// alignParser parses .align n, which pads to a multiple of 2^n bytes.
+func alignParser(p *Parser, as *Instruction) (err error) {
+	as.Imm, err = p.expectImmediate(4)
+	if err != nil {
+		return fmt.Errorf("alignment: %v", err)
+	}
+	return nil
+}
+
+func alignString(w io.Writer, as Instruction) {
+	fmt.Fprint(w, as.Imm)
+}
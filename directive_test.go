@@ -0,0 +1,43 @@
+package simleg
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDataLayout(t *testing.T) {
+	prog := parse(t, `
+	.data
+a:	.byte 1
+b:	.align 3
+c:	.word 2
+d:	.asciz "hi"
+e:	.align 2
+f:	.dword -1
+g:	.space 3
+h:	.byte 4
+	.text
+i:	LDA X1,c`)
+	labels, text, data := prog.layout()
+	want := map[string]uint64{"a": 0, "b": 8, "c": 8, "d": 12, "e": 16, "f": 16, "g": 24, "h": 27}
+	for name, off := range want {
+		if got := labels[name]; got != DataOffset+off {
+			t.Errorf("%s at %#x, want %#x", name, got, DataOffset+off)
+		}
+	}
+	if labels["i"] != TextOffset {
+		t.Errorf("i at %#x, want %#x", labels["i"], TextOffset)
+	}
+	wantData := []byte{
+		1, 0, 0, 0, 0, 0, 0, 0,
+		2, 0, 0, 0, 'h', 'i', 0, 0,
+		0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF,
+		0, 0, 0, 4,
+	}
+	if !bytes.Equal(data, wantData) {
+		t.Errorf("data = % x, want % x", data, wantData)
+	}
+	if len(text) != 2 || text[0].Imm != (DataOffset+8)&0xFFFF || text[1].Imm != (DataOffset+8)>>16 {
+		t.Errorf("LDA X1,c expands to %v", text)
+	}
+}
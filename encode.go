@@ -0,0 +1,274 @@
+package simleg
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+type formatEncoder func(as Instruction) (uint32, error)
+
+// machineOp holds the fixed fields of an instruction's machine encoding.
+type machineOp struct {
+	op    uint32 // opcode, right aligned
+	shamt uint32 // fixed shamt field for some R-format instructions
+}
+
+var machineOps = map[string]machineOp{
+	"ADD":    {op: 0x458},
+	"ADDI":   {op: 0x244},
+	"ADDIS":  {op: 0x2C4},
+	"ADDS":   {op: 0x558},
+	"AND":    {op: 0x450},
+	"ANDI":   {op: 0x248},
+	"ANDIS":  {op: 0x3C8},
+	"ANDS":   {op: 0x750},
+	"B":      {op: 0x05},
+	"BL":     {op: 0x25},
+	"BR":     {op: 0x6B0},
+	"CBNZ":   {op: 0xB5},
+	"CBZ":    {op: 0xB4},
+	"EOR":    {op: 0x650},
+	"EORI":   {op: 0x348},
+	"LDUR":   {op: 0x7C2},
+	"LDURB":  {op: 0x1C2},
+	"LDURH":  {op: 0x3C2},
+	"LDURS":  {op: 0x5E2},
+	"LDURSW": {op: 0x5C4},
+	"LDXR":   {op: 0x642},
+	"LSL":    {op: 0x69B},
+	"LSR":    {op: 0x69A},
+	"MOVK":   {op: 0x1E5},
+	"MOVZ":   {op: 0x1A5},
+	"ORR":    {op: 0x550},
+	"ORRI":   {op: 0x2C8},
+	"STUR":   {op: 0x7C0},
+	"STURB":  {op: 0x1C0},
+	"STURH":  {op: 0x3C0},
+	"STURW":  {op: 0x5C0},
+	"STXR":   {op: 0x640},
+	"SUB":    {op: 0x658},
+	"SUBI":   {op: 0x344},
+	"SUBIS":  {op: 0x3C4},
+	"SUBS":   {op: 0x758},
+
+	"FADDS": {op: 0x0F1, shamt: 0x0A},
+	"FADDD": {op: 0x0F3, shamt: 0x0A},
+	"FCMPS": {op: 0x0F1, shamt: 0x08},
+	"FCMPD": {op: 0x0F3, shamt: 0x08},
+	"FDIVS": {op: 0x0F1, shamt: 0x06},
+	"FDIVD": {op: 0x0F3, shamt: 0x06},
+	"FMULS": {op: 0x0F1, shamt: 0x02},
+	"FMULD": {op: 0x0F3, shamt: 0x02},
+	"FSUBS": {op: 0x0F1, shamt: 0x0E},
+	"FSUBD": {op: 0x0F3, shamt: 0x0E},
+	"LDURD": {op: 0x7E2},
+	"MUL":   {op: 0x4D8, shamt: 0x1F},
+	"SDIV":  {op: 0x4D6, shamt: 0x02},
+	"SMULH": {op: 0x4DA},
+	"STURS": {op: 0x5E0},
+	"STURD": {op: 0x7E0},
+	"UDIV":  {op: 0x4D6, shamt: 0x03},
+	"UMULH": {op: 0x4DE},
+}
+
+// B.cond shares the CB-format opcode 0x54 and stores the condition in Rt.
+const bcondOp = 0x54
+
+var condCodes = map[string]uint32{
+	"EQ": 0x0,
+	"NE": 0x1,
+	"HS": 0x2,
+	"LO": 0x3,
+	"MI": 0x4,
+	"PL": 0x5,
+	"VS": 0x6,
+	"VC": 0x7,
+	"HI": 0x8,
+	"LS": 0x9,
+	"GE": 0xA,
+	"LT": 0xB,
+	"GT": 0xC,
+	"LE": 0xD,
+}
+
+// Num returns the 5-bit register number used in machine encodings, which
+// for a floating point register is its index in CPU.FPRegisters.
+func (r Register) Num() uint32 {
+	switch {
+	case r >= D0:
+		return uint32(r - D0)
+	case r >= S0:
+		return uint32(r - S0)
+	default:
+		return uint32(r)
+	}
+}
+
+// Encode returns the 32-bit machine encoding of as. Branch targets must
+// already be PC-relative offsets; use Program.Encode to resolve labels.
+func (as Instruction) Encode() (uint32, error) {
+	f, ok := opcodes[as.Op]
+	if !ok {
+		return 0, fmt.Errorf("opcode not supported: %s", as.Op)
+	}
+	if f.e == nil {
+		return 0, fmt.Errorf("opcode: %s has no encoding", as.Op)
+	}
+	return f.e(as)
+}
+
+// Encode assembles the instructions of p into little-endian machine code,
+// one 32-bit word per instruction. Data directives are left out.
+func (p Program) Encode() ([]byte, error) {
+	labels, text, _ := p.layout()
+	return text.encode(labels, nil)
+}
+
+// encode assembles text, the instructions laid out from TextOffset. If
+// extern is not nil, it is given each branch to a label that is not in
+// labels, and may set its offset in place of the label.
+func (text Program) encode(labels map[string]uint64, extern func(i int, as *Instruction) error) ([]byte, error) {
+	b := make([]byte, 4*len(text))
+	for i, src := range text {
+		var err error
+		as := src
+		if _, ok := labels[as.To.Label]; !ok && as.To.Label != "" && extern != nil {
+			if err = extern(i, &as); err != nil {
+				return nil, fmt.Errorf("%s: %v", src, err)
+			}
+		}
+		pc := TextOffset + 4*uint64(i)
+		if as.To, err = resolve(as.To, labels, pc); err != nil {
+			return nil, fmt.Errorf("%s: %v", src, err)
+		}
+		if as.From, err = resolve(as.From, labels, pc); err != nil {
+			return nil, fmt.Errorf("%s: %v", src, err)
+		}
+		w, err := as.Encode()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", src, err)
+		}
+		binary.LittleEndian.PutUint32(b[4*i:], w)
+	}
+	return b, nil
+}
+
+// resolve replaces a label with its offset, in instructions, relative to pc.
+func resolve(addr Addr, labels map[string]uint64, pc uint64) (Addr, error) {
+	if addr.Label == "" {
+		return addr, nil
+	}
+	target, ok := labels[addr.Label]
+	if !ok {
+		return addr, fmt.Errorf("undefined label '%s'", addr.Label)
+	}
+	addr.Offset = int64(target-pc) / 4
+	addr.Label = ""
+	return addr, nil
+}
+
+func encodeR(op, rm, shamt, rn, rd uint32) uint32 {
+	return op<<21 | rm<<16 | shamt<<10 | rn<<5 | rd
+}
+
+func rformatEncoder(as Instruction) (uint32, error) {
+	m := machineOps[as.Op]
+	return encodeR(m.op, as.Reg.Num(), m.shamt, as.From.Reg.Num(), as.To.Reg.Num()), nil
+}
+
+// fcformatEncoder encodes FCMPS and FCMPD, which have no destination.
+func fcformatEncoder(as Instruction) (uint32, error) {
+	m := machineOps[as.Op]
+	return encodeR(m.op, as.Reg.Num(), m.shamt, as.From.Reg.Num(), 0), nil
+}
+
+func iformatEncoder(as Instruction) (uint32, error) {
+	if as.Imm >= 1<<12 {
+		return 0, fmt.Errorf("immediate %d does not fit in 12 bits", as.Imm)
+	}
+	m := machineOps[as.Op]
+	return m.op<<22 | uint32(as.Imm)<<10 | as.From.Reg.Num()<<5 | as.To.Reg.Num(), nil
+}
+
+// shformatEncoder encodes LSL and LSR, which are written like I-format
+// instructions but encoded as R-format with the shift in shamt.
+func shformatEncoder(as Instruction) (uint32, error) {
+	if as.Imm >= 1<<6 {
+		return 0, fmt.Errorf("shift %d does not fit in 6 bits", as.Imm)
+	}
+	m := machineOps[as.Op]
+	return encodeR(m.op, 0, uint32(as.Imm), as.From.Reg.Num(), as.To.Reg.Num()), nil
+}
+
+func dformatEncoder(as Instruction) (uint32, error) {
+	off := as.From.Offset
+	if off < -1<<8 || off >= 1<<8 {
+		return 0, fmt.Errorf("offset %d does not fit in 9 bits", off)
+	}
+	m := machineOps[as.Op]
+	return m.op<<21 | uint32(off)&0x1FF<<12 | as.From.Reg.Num()<<5 | as.To.Reg.Num(), nil
+}
+
+// xformatEncoder encodes STXR, which keeps its status register where a
+// D-format instruction has the upper bits of the offset.
+func xformatEncoder(as Instruction) (uint32, error) {
+	if as.From.Offset != 0 {
+		return 0, fmt.Errorf("offset must be 0")
+	}
+	return machineOps[as.Op].op<<21 | as.Reg.Num()<<16 | as.From.Reg.Num()<<5 | as.To.Reg.Num(), nil
+}
+
+func bformatEncoder(as Instruction) (uint32, error) {
+	switch {
+	case as.Op == "BR":
+		return encodeR(machineOps[as.Op].op, 0, 0, as.To.Reg.Num(), 0), nil
+	case strings.HasPrefix(as.Op, "B."):
+		cond, ok := condCodes[as.Op[len("B."):]]
+		if !ok {
+			return 0, fmt.Errorf("unknown condition %s", as.Op)
+		}
+		off, err := branchOffset(as.To, 19)
+		if err != nil {
+			return 0, err
+		}
+		return bcondOp<<24 | off<<5 | cond, nil
+	}
+	off, err := branchOffset(as.To, 26)
+	if err != nil {
+		return 0, err
+	}
+	return machineOps[as.Op].op<<26 | off, nil
+}
+
+func cbformatEncoder(as Instruction) (uint32, error) {
+	off, err := branchOffset(as.To, 19)
+	if err != nil {
+		return 0, err
+	}
+	return machineOps[as.Op].op<<24 | off<<5 | as.From.Reg.Num(), nil
+}
+
+func iwformatEncoder(as Instruction) (uint32, error) {
+	if as.Imm >= 1<<16 {
+		return 0, fmt.Errorf("immediate %d does not fit in 16 bits", as.Imm)
+	}
+	if as.Shift%16 != 0 || as.Shift > 48 {
+		return 0, fmt.Errorf("shift %d must be 0, 16, 32 or 48", as.Shift)
+	}
+	hw := uint32(as.Shift / 16)
+	return machineOps[as.Op].op<<23 | hw<<21 | uint32(as.Imm)<<5 | as.To.Reg.Num(), nil
+}
+
+// branchOffset returns the PC-relative offset of addr truncated to an
+// n-bit two's complement field.
+func branchOffset(addr Addr, n uint) (uint32, error) {
+	if addr.Label != "" {
+		return 0, fmt.Errorf("unresolved label '%s'", addr.Label)
+	}
+	off := addr.Offset
+	if off < -1<<(n-1) || off >= 1<<(n-1) {
+		return 0, fmt.Errorf("branch offset %d does not fit in %d bits", off, n)
+	}
+	return uint32(off) & (1<<n - 1), nil
+}
@@ -0,0 +1,118 @@
+package simleg
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// Encodings worked out from the fields on the LEGv8 reference card. Except
+// for LSL and BR, they are also those of the same AArch64 instructions.
+var encodeTests = []struct {
+	as   Instruction
+	want uint32
+}{
+	// R
+	{Instruction{Op: "ADD", To: Addr{Reg: X1}, From: Addr{Reg: X2}, Reg: X3}, 0x8B030041},
+	{Instruction{Op: "SUBS", To: Addr{Reg: X9}, From: Addr{Reg: X10}, Reg: X11}, 0xEB0B0149},
+	{Instruction{Op: "LSL", To: Addr{Reg: X1}, From: Addr{Reg: X2}, Imm: 3}, 0xD3600C41},
+	{Instruction{Op: "BR", To: Addr{Reg: LR}}, 0xD60003C0},
+	// I
+	{Instruction{Op: "ADDI", To: Addr{Reg: X1}, From: Addr{Reg: X2}, Imm: 4}, 0x91001041},
+	{Instruction{Op: "SUBI", To: Addr{Reg: SP}, From: Addr{Reg: SP}, Imm: 16}, 0xD100439C},
+	{Instruction{Op: "ANDI", To: Addr{Reg: X0}, From: Addr{Reg: X1}, Imm: 0xFFF}, 0x923FFC20},
+	// D
+	{Instruction{Op: "LDUR", To: Addr{Reg: X1}, From: Addr{Reg: X2, Offset: 8}}, 0xF8408041},
+	{Instruction{Op: "STUR", To: Addr{Reg: X1}, From: Addr{Reg: X2, Offset: -8}}, 0xF81F8041},
+	{Instruction{Op: "LDURB", To: Addr{Reg: X3}, From: Addr{Reg: X4, Offset: 255}}, 0x384FF083},
+	// B
+	{Instruction{Op: "B", To: Addr{Offset: -1}}, 0x17FFFFFF},
+	{Instruction{Op: "BL", To: Addr{Offset: 4}}, 0x94000004},
+	// CB
+	{Instruction{Op: "CBZ", From: Addr{Reg: X1}, To: Addr{Offset: 2}}, 0xB4000041},
+	{Instruction{Op: "CBNZ", From: Addr{Reg: X1}, To: Addr{Offset: -2}}, 0xB5FFFFC1},
+	{Instruction{Op: "B.NE", To: Addr{Offset: 3}}, 0x54000061},
+	{Instruction{Op: "B.LT", To: Addr{Offset: -1}}, 0x54FFFFEB},
+	// IW
+	{Instruction{Op: "MOVZ", To: Addr{Reg: X1}, Imm: 0x1234, Shift: 16}, 0xD2A24681},
+	{Instruction{Op: "MOVK", To: Addr{Reg: X2}, Imm: 0xFFFF, Shift: 48}, 0xF2FFFFE2},
+}
+
+func TestEncode(t *testing.T) {
+	for _, tt := range encodeTests {
+		got, err := tt.as.Encode()
+		if err != nil {
+			t.Errorf("%s: %v", tt.as, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s = %08x, want %08x", tt.as, got, tt.want)
+		}
+	}
+}
+
+func TestProgramEncode(t *testing.T) {
+	prog := Program{
+		{Op: "ADDI", To: Addr{Reg: X1}, From: Addr{Reg: X2}, Imm: 4, Label: "top"},
+		{Op: "CBZ", From: Addr{Reg: X1}, To: Addr{Label: "end"}},
+		{Op: "B", To: Addr{Label: "top"}},
+		{Op: "BR", To: Addr{Reg: LR}, Label: "end"},
+	}
+	b, err := prog.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []uint32{0x91001041, 0xB4000041, 0x17FFFFFE, 0xD60003C0}
+	if len(b) != 4*len(want) {
+		t.Fatalf("encoded %d bytes, want %d", len(b), 4*len(want))
+	}
+	for i, w := range want {
+		if got := binary.LittleEndian.Uint32(b[4*i:]); got != w {
+			t.Errorf("%s = %08x, want %08x", prog[i], got, w)
+		}
+	}
+}
+
+// Branch offsets just inside and just outside the range of each format.
+var branchRangeTests = []struct {
+	op     string
+	offset int64
+	ok     bool
+}{
+	{"B", 1<<25 - 1, true},
+	{"B", 1 << 25, false},
+	{"BL", -1 << 25, true},
+	{"BL", -1<<25 - 1, false},
+	{"CBZ", 1<<18 - 1, true},
+	{"CBZ", 1 << 18, false},
+	{"CBNZ", -1 << 18, true},
+	{"CBNZ", -1<<18 - 1, false},
+	{"B.GE", 1<<18 - 1, true},
+	{"B.GE", 1 << 18, false},
+	{"B.MI", -1 << 18, true},
+	{"B.MI", -1<<18 - 1, false},
+}
+
+func TestBranchRange(t *testing.T) {
+	for _, tt := range branchRangeTests {
+		as := Instruction{Op: tt.op, From: Addr{Reg: X9}, To: Addr{Offset: tt.offset}}
+		w, err := as.Encode()
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("%s encoded as %08x", as, w)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", as, err)
+			continue
+		}
+		got, err := Decode(w)
+		if err != nil {
+			t.Errorf("%s: decode %08x: %v", as, w, err)
+			continue
+		}
+		if got.To.Offset != tt.offset {
+			t.Errorf("%s decoded with offset %d", as, got.To.Offset)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package simleg
+
+import "fmt"
+
+// ErrorKind classifies an ExecError.
+type ErrorKind int
+
+const (
+	UnknownOpcode ErrorKind = iota
+	BadBranchTarget
+	UndefinedLabel
+	Misaligned
+)
+
+var errorKinds = [...]string{
+	UnknownOpcode:   "unknown opcode",
+	BadBranchTarget: "bad branch target",
+	UndefinedLabel:  "undefined label",
+	Misaligned:      "misaligned address",
+}
+
+// String implements Stringer for ErrorKind.
+func (k ErrorKind) String() string {
+	if int(k) < len(errorKinds) {
+		return errorKinds[k]
+	}
+	return fmt.Sprintf("ErrorKind(%d)", int(k))
+}
+
+// ExecError reports an instruction that could not be executed. PC still
+// points at the instruction.
+type ExecError struct {
+	PC   uint64
+	Ins  Instruction
+	Kind ErrorKind
+	Err  error // details, may be nil
+}
+
+func (e *ExecError) Error() string {
+	s := fmt.Sprintf("%#x: ", e.PC)
+	if e.Ins.Pos.IsValid() {
+		s = e.Ins.Pos.String() + ": " + s
+	}
+	if e.Ins.Op != "" {
+		s += e.Ins.String() + ": "
+	}
+	s += e.Kind.String()
+	if e.Err != nil {
+		s += ": " + e.Err.Error()
+	}
+	return s
+}
+
+func (e *ExecError) Unwrap() error { return e.Err }
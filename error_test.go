@@ -0,0 +1,68 @@
+package simleg
+
+import (
+	"errors"
+	"testing"
+)
+
+// In each program the last instruction fails.
+var execErrorTests = []struct {
+	src  string
+	kind ErrorKind
+}{
+	{"MOVZ X1,#0\nBR X1", BadBranchTarget},
+	{"MOVZ X1,#64,LSL #16\nADDI X1,X1,#2\nBR X1", Misaligned},
+	{"ADDI X1,XZR,#1\nB nowhere", UndefinedLabel},
+	{"MOVZ X1,#96,LSL #16\nLDXR X2,[X1,#4]", Misaligned},
+	{"MOVZ X1,#96,LSL #16\nSTXR X2,X3,[X1,#1]", Misaligned},
+}
+
+func TestExecError(t *testing.T) {
+	for _, tt := range execErrorTests {
+		prog := parse(t, tt.src)
+		var cpu CPU
+		if err := cpu.Load(prog); err != nil {
+			t.Fatal(err)
+		}
+		checkExecError(t, &cpu, tt.kind, prog[len(prog)-1].Pos)
+	}
+}
+
+func TestExecErrorUnknownOpcode(t *testing.T) {
+	prog := parse(t, "ADDI X1,XZR,#1\nADDI X2,XZR,#2")
+	var cpu CPU
+	if err := cpu.LoadText(prog); err != nil {
+		t.Fatal(err)
+	}
+	cpu.Memory.Write([]byte{0, 0, 0, 0}, TextOffset+4)
+	checkExecError(t, &cpu, UnknownOpcode, prog[1].Pos)
+
+	prog[1].Op = "NOP"
+	if err := cpu.Load(prog); err != nil {
+		t.Fatal(err)
+	}
+	checkExecError(t, &cpu, UnknownOpcode, prog[1].Pos)
+}
+
+// checkExecError runs cpu until it fails, and checks that it failed with
+// kind at the instruction at pos, which is the last one.
+func checkExecError(t *testing.T, cpu *CPU, kind ErrorKind, pos Pos) {
+	t.Helper()
+	for {
+		running, err := cpu.Step()
+		if err == nil && running {
+			continue
+		}
+		var e *ExecError
+		if !errors.As(err, &e) {
+			t.Fatalf("%v: Step = %v, %v, want an ExecError", pos, running, err)
+		}
+		if e.Kind != kind || e.Ins.Pos != pos || e.PC != cpu.textEnd-4 || e.PC != cpu.PC {
+			t.Errorf("%v: %s at %v, PC %#x, want %s", pos, e.Kind, e.Ins.Pos, e.PC, kind)
+		}
+		if cpu.Err != err {
+			t.Errorf("%v: cpu.Err = %v, want %v", pos, cpu.Err, err)
+		}
+		return
+	}
+}
@@ -0,0 +1,170 @@
+package simleg
+
+import (
+	"errors"
+	"fmt"
+)
+
+// An expr is an integer expression over literals and symbols.
+type expr interface {
+	eval(lookup func(name string) (int64, bool)) (int64, error)
+}
+
+type numExpr int64
+
+type symExpr string
+
+type unaryExpr struct {
+	op string
+	x  expr
+}
+
+type binaryExpr struct {
+	op   string
+	x, y expr
+}
+
+// undefinedError reports a symbol that has not been defined (yet).
+type undefinedError string
+
+func (e undefinedError) Error() string {
+	return fmt.Sprintf("undefined symbol '%s'", string(e))
+}
+
+func (e numExpr) eval(lookup func(string) (int64, bool)) (int64, error) {
+	return int64(e), nil
+}
+
+func (e symExpr) eval(lookup func(string) (int64, bool)) (int64, error) {
+	n, ok := lookup(string(e))
+	if !ok {
+		return 0, undefinedError(e)
+	}
+	return n, nil
+}
+
+func (e unaryExpr) eval(lookup func(string) (int64, bool)) (int64, error) {
+	x, err := e.x.eval(lookup)
+	if err != nil {
+		return 0, err
+	}
+	switch e.op {
+	case "-":
+		return -x, nil
+	case "~":
+		return ^x, nil
+	}
+	return x, nil
+}
+
+func (e binaryExpr) eval(lookup func(string) (int64, bool)) (int64, error) {
+	x, err := e.x.eval(lookup)
+	if err != nil {
+		return 0, err
+	}
+	y, err := e.y.eval(lookup)
+	if err != nil {
+		return 0, err
+	}
+	switch e.op {
+	case "+":
+		return x + y, nil
+	case "-":
+		return x - y, nil
+	case "*":
+		return x * y, nil
+	case "/", "%":
+		if y == 0 {
+			return 0, errors.New("division by zero")
+		}
+		if e.op == "/" {
+			return x / y, nil
+		}
+		return x % y, nil
+	case "<<", ">>":
+		if y < 0 {
+			return 0, fmt.Errorf("negative shift %d", y)
+		}
+		if e.op == "<<" {
+			return x << uint64(y), nil
+		}
+		return x >> uint64(y), nil
+	case "&":
+		return x & y, nil
+	case "|":
+		return x | y, nil
+	case "^":
+		return x ^ y, nil
+	}
+	return 0, fmt.Errorf("unknown operator %s", e.op)
+}
+
+// precedence of the binary operators, as in Go.
+var precedence = map[string]int{
+	"*": 2, "/": 2, "%": 2, "<<": 2, ">>": 2, "&": 2,
+	"+": 1, "-": 1, "|": 1, "^": 1,
+}
+
+// parseExpr parses an expression, optionally preceded by '#'.
+func (p *Parser) parseExpr() (expr, error) {
+	if p.has(itemHash) {
+		p.nextItem()
+	}
+	return p.parseBinary(1)
+}
+
+func (p *Parser) parseBinary(prec int) (expr, error) {
+	x, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		q := precedence[t.text]
+		if t.typ != itemOperator || q < prec {
+			return x, nil
+		}
+		p.nextItem()
+		y, err := p.parseBinary(q + 1)
+		if err != nil {
+			return nil, err
+		}
+		x = binaryExpr{t.text, x, y}
+	}
+}
+
+func (p *Parser) parseUnary() (expr, error) {
+	t := p.peek()
+	switch t.typ {
+	case itemOperator:
+		if t.text != "-" && t.text != "+" && t.text != "~" {
+			break
+		}
+		p.nextItem()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return unaryExpr{t.text, x}, nil
+	case itemInteger:
+		p.nextItem()
+		n, err := parseNumber(t.text)
+		return numExpr(n), err
+	case itemName:
+		p.nextItem()
+		return symExpr(t.text), nil
+	case itemLparen:
+		p.nextItem()
+		x, err := p.parseBinary(1)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(itemRparen); err != nil {
+			return nil, err
+		}
+		return x, nil
+	}
+	// report what is there instead
+	_, err := p.expect(itemInteger)
+	return nil, fmt.Errorf("expecting expression: %v", err)
+}
@@ -0,0 +1,51 @@
+package simleg
+
+import (
+	"strings"
+	"testing"
+)
+
+// Each source defines R, which should come to want, or fail with err.
+var exprTests = []struct {
+	src  string
+	want int64
+	err  string
+}{
+	{src: ".equ R, 1+2*3", want: 7},
+	{src: ".equ R, (1+2)*3", want: 9},
+	{src: ".equ R, 1<<4+1", want: 17},
+	{src: ".equ R, 10-4-3", want: 3},
+	{src: ".equ R, 2*3%4", want: 2},
+	{src: ".equ R, -2*3", want: -6},
+	{src: ".equ R, ~0&0xF", want: 15},
+	{src: ".equ R, -7/2", want: -3},
+	{src: ".equ R, 1|6^3&5", want: 6},
+	{src: ".equ R, B*2\n.equ B, A+1\n.equ A, 3", want: 8},
+	{src: ".equ R, end-start\nstart: ADD X1,X1,X1\nADD X1,X1,X1\nend: ADD X1,X1,X1", want: 8},
+	{src: ".equ R, 1/0", err: "division by zero"},
+	{src: ".equ R, 1>>-1", err: "negative shift -1"},
+	{src: ".equ R, nowhere", err: "undefined symbol 'nowhere'"},
+	{src: ".equ R, S\n.equ S, R", err: "undefined symbol"},
+	{src: ".equ R, 1\n.equ R, 2", err: "R redefined"},
+}
+
+func TestExpressions(t *testing.T) {
+	for _, tt := range exprTests {
+		p := &Parser{Filename: "test.asm"}
+		p.Use(strings.NewReader(tt.src))
+		prog, err := p.ParseAll()
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%q: %v, want %s", tt.src, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.src, err)
+			continue
+		}
+		if got := int64(prog[0].Imm); got != tt.want {
+			t.Errorf("%q: R = %d, want %d", tt.src, got, tt.want)
+		}
+	}
+}
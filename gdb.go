@@ -0,0 +1,557 @@
+package simleg
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// gdbTarget describes the registers to GDB: the AArch64 core registers,
+// where sp is another name for X28, and the D registers of LEGv8.
+var gdbTarget string
+
+func init() {
+	var sb strings.Builder
+	sb.WriteString(`<?xml version="1.0"?>
+<!DOCTYPE target SYSTEM "gdb-target.dtd">
+<target version="1.0">
+<architecture>aarch64</architecture>
+<feature name="org.gnu.gdb.aarch64.core">
+`)
+	for i := 0; i < 31; i++ {
+		fmt.Fprintf(&sb, "<reg name=\"x%d\" bitsize=\"64\" type=\"int\"/>\n", i)
+	}
+	sb.WriteString(`<reg name="sp" bitsize="64" type="data_ptr"/>
+<reg name="pc" bitsize="64" type="code_ptr"/>
+<reg name="cpsr" bitsize="32"/>
+</feature>
+<feature name="org.simleg.legv8.fp">
+`)
+	for i := 0; i < 32; i++ {
+		fmt.Fprintf(&sb, "<reg name=\"d%d\" bitsize=\"64\" type=\"ieee_double\"/>\n", i)
+	}
+	sb.WriteString("</feature>\n</target>\n")
+	gdbTarget = sb.String()
+}
+
+// GDB register numbers, in the order of gdbTarget.
+const (
+	gdbSP   = 31
+	gdbPC   = 32
+	gdbCPSR = 33
+	gdbD0   = 34
+	gdbRegs = gdbD0 + 32
+)
+
+// GDB signal numbers reported when the program stops.
+const (
+	sigILL  = 4
+	sigTRAP = 5
+	sigBUS  = 7
+	sigSEGV = 11
+)
+
+// gdbStub serves one GDB session.
+type gdbStub struct {
+	cpu     *CPU
+	mu      sync.Mutex // guards w and ack
+	w       *bufio.Writer
+	ack     bool          // acknowledge packets, until QStartNoAckMode
+	packets chan string   // from the client, or "\x03" for an interrupt
+	errc    chan error    // why the client stopped sending
+	done    chan struct{} // closed when ServeGDB returns
+
+	breaks  map[uint64]bool
+	watches []Watchpoint
+}
+
+// ServeGDB lets a GDB client debug the program loaded on cpu over rw,
+// which is usually a network connection, using the GDB Remote Serial
+// Protocol. It supports reading and writing registers and memory, single
+// steps, continuing, and breakpoints and watchpoints set with Z packets.
+// ServeGDB returns once the client detaches or kills the program, or rw
+// fails. It reads rw from another goroutine, which ends only when a read
+// fails, so the caller must close rw after ServeGDB returns.
+func ServeGDB(rw io.ReadWriter, cpu *CPU) error {
+	s := &gdbStub{
+		cpu:     cpu,
+		w:       bufio.NewWriter(rw),
+		packets: make(chan string),
+		errc:    make(chan error, 1),
+		done:    make(chan struct{}),
+		ack:     true,
+		breaks:  make(map[uint64]bool),
+	}
+	defer close(s.done)
+	go s.read(bufio.NewReader(rw))
+	for {
+		var pkt string
+		select {
+		case pkt = <-s.packets:
+		case err := <-s.errc:
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		switch {
+		case pkt == "\x03":
+			continue // not running
+		case strings.HasPrefix(pkt, "k"):
+			return nil
+		}
+		reply, err := s.handle(pkt)
+		if err == nil || err == errDetached {
+			if err := s.send(reply); err != nil {
+				return err
+			}
+		}
+		if err == errDetached || err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// errDetached ends a session once the reply is sent.
+var errDetached = errors.New("detached")
+
+// read passes the packets the client sends to s.packets, acknowledging
+// them if need be, until it fails or ServeGDB returns.
+func (s *gdbStub) read(r *bufio.Reader) {
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			s.fail(err)
+			return
+		}
+		switch c {
+		case 0x03:
+			if !s.deliver("\x03") {
+				return
+			}
+			continue
+		case '$':
+		default:
+			continue // acknowledgements, or noise
+		}
+		data, err := r.ReadString('#')
+		if err != nil {
+			s.fail(err)
+			return
+		}
+		var sum [2]byte
+		if _, err := io.ReadFull(r, sum[:]); err != nil {
+			s.fail(err)
+			return
+		}
+		data = data[:len(data)-1]
+		ok := fmt.Sprintf("%02x", checksum(data)) == strings.ToLower(string(sum[:]))
+		s.mu.Lock()
+		ack := s.ack
+		if ack && ok {
+			s.w.WriteString("+")
+		} else if ack {
+			s.w.WriteString("-")
+		}
+		s.w.Flush()
+		s.mu.Unlock()
+		if ack && !ok {
+			continue
+		}
+		if !s.deliver(unescape(data)) {
+			return
+		}
+	}
+}
+
+// deliver passes pkt to ServeGDB, and reports whether it is still serving.
+func (s *gdbStub) deliver(pkt string) bool {
+	select {
+	case s.packets <- pkt:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// fail passes the error that stopped read to ServeGDB, if it is still
+// serving.
+func (s *gdbStub) fail(err error) {
+	select {
+	case s.errc <- err:
+	case <-s.done:
+	}
+}
+
+func checksum(data string) byte {
+	var sum byte
+	for i := 0; i < len(data); i++ {
+		sum += data[i]
+	}
+	return sum
+}
+
+// unescape undoes the escaping of '#', '$', '}' and '*' in binary data.
+func unescape(data string) string {
+	if !strings.Contains(data, "}") {
+		return data
+	}
+	var sb strings.Builder
+	for i := 0; i < len(data); i++ {
+		if data[i] == '}' && i+1 < len(data) {
+			i++
+			sb.WriteByte(data[i] ^ 0x20)
+			continue
+		}
+		sb.WriteByte(data[i])
+	}
+	return sb.String()
+}
+
+// send sends a packet to the client.
+func (s *gdbStub) send(data string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintf(s.w, "$%s#%02x", data, checksum(data))
+	return s.w.Flush()
+}
+
+// handle returns the reply to pkt. It returns errDetached if the session
+// is over, or the error that ended it while the program ran.
+func (s *gdbStub) handle(pkt string) (reply string, err error) {
+	if pkt == "" {
+		return "", nil
+	}
+	args := pkt[1:]
+	switch pkt[0] {
+	case '?':
+		return fmt.Sprintf("S%02x", sigTRAP), nil
+	case 'g':
+		var sb strings.Builder
+		for r := 0; r < gdbRegs; r++ {
+			sb.WriteString(s.register(r))
+		}
+		return sb.String(), nil
+	case 'G':
+		for r := 0; r < gdbRegs && args != ""; r++ {
+			n := len(s.register(r))
+			if len(args) < n {
+				return "E01", nil
+			}
+			if err := s.setRegister(r, args[:n]); err != nil {
+				return "E01", nil
+			}
+			args = args[n:]
+		}
+		return "OK", nil
+	case 'p':
+		r, err := strconv.ParseUint(args, 16, 32)
+		if err != nil || r >= gdbRegs {
+			return "E01", nil
+		}
+		return s.register(int(r)), nil
+	case 'P':
+		i := strings.IndexByte(args, '=')
+		if i < 0 {
+			return "E01", nil
+		}
+		r, err := strconv.ParseUint(args[:i], 16, 32)
+		if err != nil || r >= gdbRegs || s.setRegister(int(r), args[i+1:]) != nil {
+			return "E01", nil
+		}
+		return "OK", nil
+	case 'm':
+		addr, n, _, err := parseAddrLen(args)
+		if err != nil || n > 0x10000 {
+			return "E01", nil
+		}
+		b := make([]byte, n)
+		s.cpu.Memory.Read(b, addr)
+		return hex.EncodeToString(b), nil
+	case 'M', 'X':
+		addr, n, data, err := parseAddrLen(args)
+		if err != nil {
+			return "E01", nil
+		}
+		b := []byte(data)
+		if pkt[0] == 'M' {
+			if b, err = hex.DecodeString(data); err != nil {
+				return "E01", nil
+			}
+		}
+		if uint64(len(b)) != n {
+			return "E01", nil
+		}
+		s.cpu.Memory.Write(b, addr)
+		return "OK", nil
+	case 'c', 's':
+		if args != "" {
+			addr, err := strconv.ParseUint(args, 16, 64)
+			if err != nil {
+				return "E01", nil
+			}
+			s.cpu.PC = addr
+		}
+		opts := RunOptions{Watchpoints: s.watches}
+		for addr := range s.breaks {
+			opts.Breakpoints = append(opts.Breakpoints, Breakpoint{Addr: addr})
+		}
+		if pkt[0] == 's' {
+			opts.MaxSteps = 1
+		}
+		return s.resume(opts)
+	case 'Z', 'z':
+		return s.breakpoint(pkt[0] == 'Z', args), nil
+	case 'H', 'T':
+		return "OK", nil // there is one thread
+	case 'D':
+		return "OK", errDetached
+	case 'q', 'Q':
+		return s.query(pkt), nil
+	}
+	return "", nil // not supported
+}
+
+// query answers the general query packets GDB needs.
+func (s *gdbStub) query(pkt string) string {
+	switch {
+	case strings.HasPrefix(pkt, "qSupported"):
+		return "PacketSize=4000;qXfer:features:read+;QStartNoAckMode+;swbreak+"
+	case pkt == "QStartNoAckMode":
+		s.mu.Lock()
+		s.ack = false
+		s.mu.Unlock()
+		return "OK"
+	case strings.HasPrefix(pkt, "qXfer:features:read:target.xml:"):
+		off, n, _, err := parseAddrLen(strings.TrimPrefix(pkt, "qXfer:features:read:target.xml:"))
+		if err != nil {
+			return "E01"
+		}
+		if off >= uint64(len(gdbTarget)) {
+			return "l"
+		}
+		if end := off + n; end < uint64(len(gdbTarget)) {
+			return "m" + gdbTarget[off:end]
+		}
+		return "l" + gdbTarget[off:]
+	case pkt == "qAttached":
+		return "1"
+	case pkt == "qC":
+		return "QC1"
+	case pkt == "qfThreadInfo":
+		return "m1"
+	case pkt == "qsThreadInfo":
+		return "l"
+	case strings.HasPrefix(pkt, "qSymbol"):
+		return "OK"
+	}
+	return ""
+}
+
+// breakpoint sets or clears the breakpoint or watchpoint described by the
+// arguments of a Z or z packet.
+func (s *gdbStub) breakpoint(set bool, args string) string {
+	f := strings.Split(args, ",")
+	if len(f) < 3 {
+		return "E01"
+	}
+	addr, err := strconv.ParseUint(f[1], 16, 64)
+	if err != nil {
+		return "E01"
+	}
+	size, err := strconv.ParseUint(f[2], 16, 64)
+	if err != nil {
+		return "E01"
+	}
+	var kind AccessKind
+	switch f[0] {
+	case "0", "1":
+		if _, ok := s.cpu.Instruction(addr); !ok {
+			return "E01"
+		}
+		if set {
+			s.breaks[addr] = true
+		} else {
+			delete(s.breaks, addr)
+		}
+		return "OK"
+	case "2":
+		kind = AccessWrite
+	case "3":
+		kind = AccessRead
+	case "4":
+		kind = AccessRead | AccessWrite
+	default:
+		return ""
+	}
+	w := Watchpoint{Addr: addr, Size: size, Kind: kind}
+	for i := range s.watches {
+		if s.watches[i] == w {
+			s.watches = append(s.watches[:i], s.watches[i+1:]...)
+			break
+		}
+	}
+	if set {
+		s.watches = append(s.watches, w)
+	}
+	return "OK"
+}
+
+// resume runs the program with opts until it stops, or the client
+// interrupts it, and returns the stop reply.
+func (s *gdbStub) resume(opts RunOptions) (reply string, err error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	type result struct {
+		stop Stop
+		err  error
+	}
+	res := make(chan result, 1)
+	go func() {
+		stop, err := s.cpu.Run(ctx, opts)
+		res <- result{stop, err}
+	}()
+	var r result
+	for waiting := true; waiting; {
+		select {
+		case r = <-res:
+			waiting = false
+		case pkt := <-s.packets:
+			if pkt == "\x03" {
+				cancel()
+			}
+		case err := <-s.errc:
+			// the client is gone
+			cancel()
+			<-res
+			return "", err
+		}
+	}
+
+	switch r.stop.Reason {
+	case StopExited:
+		return fmt.Sprintf("W%02x", uint8(s.cpu.Registers[X0])), nil
+	case StopFault:
+		sig := sigSEGV
+		var ee *ExecError
+		if errors.As(r.err, &ee) {
+			switch ee.Kind {
+			case UnknownOpcode:
+				sig = sigILL
+			case Misaligned:
+				sig = sigBUS
+			}
+		}
+		return fmt.Sprintf("S%02x", sig), nil
+	case StopCanceled:
+		return fmt.Sprintf("S%02x", 2), nil // SIGINT
+	case StopBreakpoint:
+		return fmt.Sprintf("T%02xswbreak:;", sigTRAP), nil
+	case StopWatchpoint:
+		name := "awatch"
+		switch opts.Watchpoints[r.stop.Watchpoint].Kind {
+		case AccessWrite:
+			name = "watch"
+		case AccessRead:
+			name = "rwatch"
+		}
+		return fmt.Sprintf("T%02x%s:%x;", sigTRAP, name, r.stop.Access.Addr), nil
+	}
+	return fmt.Sprintf("S%02x", sigTRAP), nil
+}
+
+// register returns the value of GDB register r as target-endian hex.
+func (s *gdbStub) register(r int) string {
+	var b [8]byte
+	n := 8
+	switch {
+	case r < gdbSP:
+		binary.LittleEndian.PutUint64(b[:], s.cpu.Registers[r])
+	case r == gdbSP:
+		binary.LittleEndian.PutUint64(b[:], s.cpu.Registers[SP])
+	case r == gdbPC:
+		binary.LittleEndian.PutUint64(b[:], s.cpu.PC)
+	case r == gdbCPSR:
+		binary.LittleEndian.PutUint32(b[:], s.cpu.Flags.cpsr())
+		n = 4
+	default:
+		binary.LittleEndian.PutUint64(b[:], s.cpu.FPRegisters[r-gdbD0])
+	}
+	return hex.EncodeToString(b[:n])
+}
+
+// setRegister sets GDB register r from target-endian hex. Any fault the
+// program stopped at is cleared, so that it may be run again.
+func (s *gdbStub) setRegister(r int, value string) error {
+	b, err := hex.DecodeString(value)
+	if err != nil || len(b) > 8 {
+		return errors.New("bad register value")
+	}
+	var d [8]byte
+	copy(d[:], b)
+	v := binary.LittleEndian.Uint64(d[:])
+	switch {
+	case r < gdbSP:
+		s.cpu.Registers[r] = v
+	case r == gdbSP:
+		s.cpu.Registers[SP] = v
+	case r == gdbPC:
+		s.cpu.PC = v
+	case r == gdbCPSR:
+		s.cpu.Flags = cpsrFlags(uint32(v))
+	default:
+		s.cpu.FPRegisters[r-gdbD0] = v
+	}
+	s.cpu.Err = nil
+	return nil
+}
+
+// cpsr returns the flags as they appear in the AArch64 CPSR.
+func (f condFlag) cpsr() uint32 {
+	var v uint32
+	for i, flag := range [...]condFlag{flagV, flagC, flagZ, flagN} {
+		if f&flag != 0 {
+			v |= 1 << (28 + uint(i))
+		}
+	}
+	return v
+}
+
+func cpsrFlags(v uint32) condFlag {
+	var f condFlag
+	for i, flag := range [...]condFlag{flagV, flagC, flagZ, flagN} {
+		if v&(1<<(28+uint(i))) != 0 {
+			f |= flag
+		}
+	}
+	return f
+}
+
+// parseAddrLen parses "addr,length", optionally followed by ":data", in
+// hexadecimal.
+func parseAddrLen(args string) (addr, n uint64, data string, err error) {
+	if i := strings.IndexByte(args, ':'); i >= 0 {
+		args, data = args[:i], args[i+1:]
+	}
+	f := strings.Split(args, ",")
+	if len(f) != 2 {
+		return 0, 0, "", errors.New("want addr,length")
+	}
+	if addr, err = strconv.ParseUint(f[0], 16, 64); err != nil {
+		return 0, 0, "", err
+	}
+	if n, err = strconv.ParseUint(f[1], 16, 64); err != nil {
+		return 0, 0, "", err
+	}
+	return addr, n, data, nil
+}
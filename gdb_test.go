@@ -0,0 +1,179 @@
+package simleg
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// gdbClient speaks the client side of the GDB Remote Serial Protocol.
+type gdbClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+	ack  bool
+}
+
+func (c *gdbClient) write(s string) {
+	c.t.Helper()
+	if _, err := c.conn.Write([]byte(s)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// expect reads an acknowledgement.
+func (c *gdbClient) expect(want byte) {
+	c.t.Helper()
+	b, err := c.r.ReadByte()
+	if err != nil || b != want {
+		c.t.Fatalf("read %q, %v, want %q", b, err, want)
+	}
+}
+
+// reply reads a packet and checks its checksum.
+func (c *gdbClient) reply() string {
+	c.t.Helper()
+	if _, err := c.r.ReadString('$'); err != nil {
+		c.t.Fatal(err)
+	}
+	data, err := c.r.ReadString('#')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	data = data[:len(data)-1]
+	sum := make([]byte, 2)
+	if _, err := io.ReadFull(c.r, sum); err != nil {
+		c.t.Fatal(err)
+	}
+	if want := fmt.Sprintf("%02x", checksum(data)); string(sum) != want {
+		c.t.Errorf("checksum of %q is %s, want %s", data, sum, want)
+	}
+	return data
+}
+
+// call sends pkt and returns the reply.
+func (c *gdbClient) call(pkt string) string {
+	c.t.Helper()
+	c.write(fmt.Sprintf("$%s#%02x", pkt, checksum(pkt)))
+	if c.ack {
+		c.expect('+')
+	}
+	return c.reply()
+}
+
+// check sends pkt and checks the reply.
+func (c *gdbClient) check(pkt, want string) {
+	c.t.Helper()
+	if got := c.call(pkt); got != want {
+		c.t.Errorf("%q: reply %q, want %q", pkt, got, want)
+	}
+}
+
+// serveGDB loads src and serves it to a client, which is returned with a
+// channel that receives the result of ServeGDB.
+func serveGDB(t *testing.T, src string) (*gdbClient, *CPU, chan error) {
+	t.Helper()
+	var cpu CPU
+	if err := cpu.Load(parse(t, src)); err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.Pipe()
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	errc := make(chan error, 1)
+	go func() {
+		errc <- ServeGDB(server, &cpu)
+	}()
+	return &gdbClient{t: t, conn: client, r: bufio.NewReader(client), ack: true}, &cpu, errc
+}
+
+// leHex formats v as a 64-bit register value in target-endian hex.
+func leHex(v uint64) string {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	return hex.EncodeToString(b[:])
+}
+
+const gdbSource = `
+	ADDI X1,XZR,#5
+	LDA X9,value
+loop:	STUR X1,[X9,#0]
+	SUBIS X1,X1,#1
+	B.NE loop
+	ADDI X0,XZR,#7
+	.data
+value:	.dword 0
+`
+
+func TestServeGDB(t *testing.T) {
+	c, cpu, errc := serveGDB(t, gdbSource)
+	loop := cpu.Labels()["loop"]
+
+	c.write("$?#00")
+	c.expect('-')
+	c.check("?", "S05")
+
+	regs := c.call("g")
+	if len(regs) != (33+32)*16+8 {
+		t.Fatalf("g: %d hex digits", len(regs))
+	}
+	if pc := regs[32*16 : 33*16]; pc != leHex(TextOffset) {
+		t.Errorf("g: pc = %s", pc)
+	}
+	x2 := strings.Repeat("22", 8)
+	c.check("G"+regs[:2*16]+x2+regs[3*16:], "OK")
+	c.check("p2", x2)
+	c.check("P1="+leHex(10), "OK")
+	c.check("p1", leHex(10))
+	c.check("p20", leHex(TextOffset))
+	c.check("p99", "E01")
+
+	addr := fmt.Sprintf("%x", DataOffset)
+	c.check("m"+addr+",8", "0000000000000000")
+	c.check("M"+addr+",4:01020304", "OK")
+	c.check("X"+fmt.Sprintf("%x", DataOffset+4)+",3:A}\x03}]", "OK")
+	c.check("m"+addr+",8", "0102030441237d00")
+
+	c.check(fmt.Sprintf("Z0,%x,4", loop), "OK")
+	c.check("c", "T05swbreak:;")
+	c.check("p20", leHex(loop))
+	c.check("p1", leHex(5))
+	c.check(fmt.Sprintf("z0,%x,4", loop), "OK")
+	c.check("s", "S05")
+	c.check("m"+addr+",8", leHex(5))
+	c.check("p20", leHex(loop+4))
+
+	// X1 is too large for the loop to end before it is interrupted
+	c.check("P1="+strings.Repeat("ff", 8), "OK")
+	c.write("$c#63")
+	c.expect('+')
+	c.write("\x03")
+	if got := c.reply(); got != "S02" {
+		t.Errorf("interrupt: reply %q, want S02", got)
+	}
+
+	c.check("D", "OK")
+	if err := <-errc; err != nil {
+		t.Errorf("ServeGDB = %v after D", err)
+	}
+}
+
+func TestServeGDBKill(t *testing.T) {
+	c, _, errc := serveGDB(t, gdbSource)
+	c.check("QStartNoAckMode", "OK")
+	c.ack = false
+	c.check("c", "W07")
+	c.write("$k#6b")
+	if err := <-errc; err != nil {
+		t.Errorf("ServeGDB = %v after k", err)
+	}
+}
@@ -0,0 +1,241 @@
+package simleg
+
+import (
+	"context"
+	"errors"
+)
+
+// A Write is a store recorded in the history of a CPU.
+type Write struct {
+	Step int    // number of the instruction that made it, counting from 0
+	PC   uint64 // address of the instruction
+	Addr uint64
+	Old  []byte
+	New  []byte
+}
+
+// history is the undo log kept by a recording CPU.
+type history struct {
+	limit   int      // most changes kept, or 0 for no limit
+	dropped int      // changes dropped to keep within limit
+	changes []change // one for each instruction run, oldest first
+	writes  []Write  // made by the instruction running
+	remove  func()   // the memory hook
+}
+
+// A change records what one instruction changed, so it can be undone.
+type change struct {
+	pc       uint64
+	flags    condFlag
+	granule  uint64 // reserved by LDXR
+	reserved bool
+	regs     []regChange
+	writes   []Write
+}
+
+// regChange holds the old value of a register: Registers[r] if r < 32,
+// otherwise FPRegisters[r-32].
+type regChange struct {
+	r   uint8
+	old uint64
+}
+
+// Record makes the CPU keep a history of the changes each instruction
+// makes to it and to its Memory, so that they can be undone by StepBack.
+// At most limit instructions are kept, or all of them if limit is 0.
+// Recording starts again from scratch, and continues across Load.
+// Memory is shared by the cores of a Machine, but only a CPU's own stores
+// are undone.
+func (cpu *CPU) Record(limit int) {
+	cpu.StopRecording()
+	if cpu.Memory == nil {
+		cpu.Memory = &Memory{}
+	}
+	h := &history{limit: limit}
+	h.remove = cpu.Memory.Hook(func(a Access) {
+		if a.CPU != cpu || a.Kind != AccessWrite {
+			return
+		}
+		w := Write{Addr: a.Addr, Old: make([]byte, len(a.Data)), New: append([]byte(nil), a.Data...)}
+		cpu.Memory.Read(w.Old, a.Addr)
+		h.writes = append(h.writes, w)
+	})
+	cpu.history = h
+}
+
+// StopRecording discards the history of the CPU and stops recording it.
+func (cpu *CPU) StopRecording() {
+	if cpu.history != nil {
+		cpu.history.remove()
+		cpu.history = nil
+	}
+}
+
+// Recorded returns the number of instructions that StepBack can undo.
+func (cpu *CPU) Recorded() int {
+	if cpu.history == nil {
+		return 0
+	}
+	return len(cpu.history.changes)
+}
+
+// registerState is what an instruction may change besides memory.
+type registerState struct {
+	pc       uint64
+	regs     [32]uint64
+	fp       [32]uint64
+	flags    condFlag
+	granule  uint64
+	reserved bool
+}
+
+func (cpu *CPU) registerState() registerState {
+	g, ok := cpu.Memory.reservation(cpu)
+	return registerState{cpu.PC, cpu.Registers, cpu.FPRegisters, cpu.Flags, g, ok}
+}
+
+// add records the changes made by the instruction that ran since before,
+// and the writes it made.
+func (h *history) add(before registerState, cpu *CPU) {
+	c := change{pc: before.pc, flags: before.flags, granule: before.granule, reserved: before.reserved, writes: h.writes}
+	h.writes = nil
+	for i := range before.regs {
+		if before.regs[i] != cpu.Registers[i] {
+			c.regs = append(c.regs, regChange{uint8(i), before.regs[i]})
+		}
+		if before.fp[i] != cpu.FPRegisters[i] {
+			c.regs = append(c.regs, regChange{uint8(32 + i), before.fp[i]})
+		}
+	}
+	step := h.dropped + len(h.changes)
+	for i := range c.writes {
+		c.writes[i].Step, c.writes[i].PC = step, before.pc
+	}
+	h.changes = append(h.changes, c)
+	if h.limit > 0 && len(h.changes) > h.limit {
+		h.changes = h.changes[1:]
+		h.dropped++
+	}
+}
+
+// reset forgets every change, as when a program is loaded.
+func (h *history) reset() {
+	h.dropped, h.changes, h.writes = 0, nil, nil
+}
+
+// StepBack undoes the last instruction the CPU ran, and reports whether
+// there was one in its history. The CPU's exclusive reservation is put
+// back as it was, and any fault the CPU stopped at is cleared.
+func (cpu *CPU) StepBack() bool {
+	h := cpu.history
+	if h == nil || len(h.changes) == 0 {
+		return false
+	}
+	c := h.changes[len(h.changes)-1]
+	h.changes = h.changes[:len(h.changes)-1]
+	for i := len(c.writes) - 1; i >= 0; i-- {
+		cpu.Memory.Write(c.writes[i].Old, c.writes[i].Addr)
+	}
+	cpu.Memory.reserve(cpu, c.granule, c.reserved)
+	for _, rc := range c.regs {
+		if rc.r < 32 {
+			cpu.Registers[rc.r] = rc.old
+		} else {
+			cpu.FPRegisters[rc.r-32] = rc.old
+		}
+	}
+	cpu.PC, cpu.Flags, cpu.Err = c.pc, c.flags, nil
+	return true
+}
+
+// LastWrite returns the most recent store the CPU made to addr that is
+// still in its history.
+func (cpu *CPU) LastWrite(addr uint64) (Write, bool) {
+	if cpu.history == nil {
+		return Write{}, false
+	}
+	changes := cpu.history.changes
+	for i := len(changes) - 1; i >= 0; i-- {
+		writes := changes[i].writes
+		for j := len(writes) - 1; j >= 0; j-- {
+			w := writes[j]
+			if addr >= w.Addr && addr < w.Addr+uint64(len(w.New)) {
+				return w, true
+			}
+		}
+	}
+	return Write{}, false
+}
+
+// ReverseContinue undoes instructions until one of the conditions in
+// opts is met, or the start of the history is reached. It stops at
+// a breakpoint when PC gets back to it, and at a watchpoint when it
+// undoes a store to it; loads are not recorded. Registers stop it when an
+// undone instruction had changed them, with Old and New the values before
+// and after it is undone, and Until is called with each instruction
+// undone. If ctx is done, it returns ctx.Err().
+func (cpu *CPU) ReverseContinue(ctx context.Context, opts RunOptions) (Stop, error) {
+	if cpu.history == nil {
+		return Stop{PC: cpu.PC}, errors.New("not recording")
+	}
+	breaks, err := cpu.breakpoints(opts.Breakpoints)
+	if err != nil {
+		return Stop{PC: cpu.PC}, err
+	}
+	var stop Stop
+	regs := make([]uint64, len(opts.Registers))
+	for {
+		stop.PC = cpu.PC
+		select {
+		case <-ctx.Done():
+			stop.Reason = StopCanceled
+			return stop, ctx.Err()
+		default:
+		}
+		if opts.MaxSteps > 0 && stop.Steps >= opts.MaxSteps {
+			stop.Reason = StopStepLimit
+			return stop, nil
+		}
+		changes := cpu.history.changes
+		if len(changes) == 0 {
+			stop.Reason = StopHistoryStart
+			return stop, nil
+		}
+		c := changes[len(changes)-1]
+		for i, r := range opts.Registers {
+			regs[i] = cpu.register(r)
+		}
+
+		cpu.StepBack()
+		stop.PC = cpu.PC
+		stop.Steps++
+		for _, w := range c.writes {
+			for i, wp := range opts.Watchpoints {
+				if wp.Kind&AccessWrite != 0 && w.Addr < wp.Addr+wp.Size && wp.Addr < w.Addr+uint64(len(w.New)) {
+					stop.Reason = StopWatchpoint
+					stop.Watchpoint = i
+					stop.Access = Access{cpu, AccessWrite, w.Addr, w.New}
+					return stop, nil
+				}
+			}
+		}
+		for i, r := range opts.Registers {
+			if v := cpu.register(r); v != regs[i] {
+				stop.Reason = StopRegister
+				stop.Register, stop.Old, stop.New = r, regs[i], v
+				return stop, nil
+			}
+		}
+		if opts.Until != nil {
+			if as, _ := cpu.Instruction(cpu.PC); opts.Until(as) {
+				stop.Reason = StopUntil
+				return stop, nil
+			}
+		}
+		if i, ok := breaks[cpu.PC]; ok {
+			stop.Reason = StopBreakpoint
+			stop.Breakpoint = i
+			return stop, nil
+		}
+	}
+}
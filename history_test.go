@@ -0,0 +1,174 @@
+package simleg
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+)
+
+// snapshot is the state of a CPU and the memory its program uses.
+type snapshot struct {
+	pc       uint64
+	regs, fp [32]uint64
+	flags    condFlag
+	data     [48]byte
+	stack    [16]byte
+	granule  uint64
+	reserved bool
+}
+
+func takeSnapshot(cpu *CPU) snapshot {
+	s := snapshot{pc: cpu.PC, regs: cpu.Registers, fp: cpu.FPRegisters, flags: cpu.Flags}
+	cpu.Memory.Read(s.data[:], DataOffset)
+	cpu.Memory.Read(s.stack[:], StackOffset-16)
+	s.granule, s.reserved = cpu.Memory.reservation(cpu)
+	return s
+}
+
+const historySource = `
+	ADDI X1,XZR,#5
+	SUBIS X2,X1,#7
+	LDA X9,value
+	LDXR X3,[X9,#0]
+	STUR X1,[X9,#8]
+	LDXR X3,[X9,#0]
+	LDURD D1,[X9,#16]
+	FADDD D2,D1,D1
+	STURD D2,[X9,#24]
+	STXR X1,X4,[X9,#0]
+	SUBI SP,SP,#16
+	STUR X2,[SP,#0]
+	LDXR X5,[X9,#32]
+	.data
+value:	.dword 1,2,3,4,5
+`
+
+func TestStepBack(t *testing.T) {
+	var cpu CPU
+	cpu.Record(0)
+	if err := cpu.Load(parse(t, historySource)); err != nil {
+		t.Fatal(err)
+	}
+	snaps := []snapshot{takeSnapshot(&cpu)}
+	for {
+		running, err := cpu.Step()
+		if err != nil {
+			t.Fatal(err)
+		}
+		snaps = append(snaps, takeSnapshot(&cpu))
+		if !running {
+			break
+		}
+	}
+	if n := cpu.Recorded(); n != len(snaps)-1 {
+		t.Fatalf("Recorded = %d, want %d", n, len(snaps)-1)
+	}
+	for i := len(snaps) - 2; i >= 0; i-- {
+		if !cpu.StepBack() {
+			t.Fatalf("StepBack to step %d failed", i)
+		}
+		if got := takeSnapshot(&cpu); got != snaps[i] {
+			t.Errorf("StepBack to step %d:\n%+v\nwant\n%+v", i, got, snaps[i])
+		}
+	}
+	if cpu.StepBack() {
+		t.Error("StepBack past the start of the history")
+	}
+}
+
+func TestStepBackLoadText(t *testing.T) {
+	var cpu CPU
+	cpu.Record(0)
+	prog := parse(t, "MOVZ X9,#64,LSL #16\nSTURW X2,[X9,#12]\nADDI X1,XZR,#1\nADDI X3,XZR,#3")
+	if err := cpu.LoadText(prog); err != nil {
+		t.Fatal(err)
+	}
+	w, err := Instruction{Op: "SUBI", To: Addr{Reg: X3}, From: Addr{Reg: XZR}, Imm: 3}.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu.Registers[X2] = uint64(w)
+	for {
+		running, err := cpu.Step()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !running {
+			break
+		}
+	}
+	if cpu.Registers[X3] != neg(3) {
+		t.Fatalf("X3 = %#x, want the patched SUBI to set -3", cpu.Registers[X3])
+	}
+	for i := 0; i < 3; i++ {
+		cpu.StepBack()
+	}
+	if as, _ := cpu.Instruction(TextOffset + 12); as.String() != "ADDI X3,XZR,#3" {
+		t.Errorf("after undoing the store, Instruction = %s", as)
+	}
+	var b [4]byte
+	cpu.Memory.Read(b[:], TextOffset+12)
+	if want, _ := prog[3].Encode(); binary.LittleEndian.Uint32(b[:]) != want {
+		t.Errorf("text word = %#x, want %#x", binary.LittleEndian.Uint32(b[:]), want)
+	}
+}
+
+const reverseSource = `
+	ADDI X1,XZR,#3
+	LDA X9,value
+loop:	STUR X1,[X9,#0]
+	SUBIS X1,X1,#1
+	B.NE loop
+	ADDI X2,XZR,#9
+	.data
+value:	.dword 0
+`
+
+func TestReverseContinue(t *testing.T) {
+	var cpu CPU
+	cpu.Record(0)
+	if err := cpu.Load(parse(t, reverseSource)); err != nil {
+		t.Fatal(err)
+	}
+	if stop, err := cpu.Run(context.Background(), RunOptions{}); err != nil || stop.Reason != StopExited {
+		t.Fatalf("Run stopped for %s, %v", stop.Reason, err)
+	}
+	loop := cpu.Labels()["loop"]
+	value := cpu.Labels()["value"]
+	checkLastWrite := func(step int, old, new uint64) {
+		t.Helper()
+		w, ok := cpu.LastWrite(value + 4)
+		if !ok || w.Step != step || w.PC != loop || w.Addr != value ||
+			binary.LittleEndian.Uint64(w.Old) != old || binary.LittleEndian.Uint64(w.New) != new {
+			t.Errorf("LastWrite = %+v, %v, want step %d at %#x writing %d over %d", w, ok, step, loop, new, old)
+		}
+	}
+	checkLastWrite(9, 2, 1)
+
+	stop, err := cpu.ReverseContinue(context.Background(), RunOptions{Breakpoints: []Breakpoint{{Label: "loop"}}})
+	if err != nil || stop.Reason != StopBreakpoint || stop.PC != loop || stop.Steps != 4 {
+		t.Errorf("ReverseContinue to loop = %+v, %v", stop, err)
+	}
+	if cpu.Registers[X1] != 1 {
+		t.Errorf("X1 = %d at the last STUR, want 1", cpu.Registers[X1])
+	}
+	checkLastWrite(6, 3, 2)
+
+	watch := []Watchpoint{{Addr: value, Size: 8, Kind: AccessWrite}}
+	stop, err = cpu.ReverseContinue(context.Background(), RunOptions{Watchpoints: watch})
+	if err != nil || stop.Reason != StopWatchpoint || stop.PC != loop || stop.Steps != 3 {
+		t.Errorf("ReverseContinue to the watchpoint = %+v, %v", stop, err)
+	}
+	if binary.LittleEndian.Uint64(stop.Access.Data) != 2 || stop.Access.Addr != value {
+		t.Errorf("watchpoint access = %+v, want the write of 2", stop.Access)
+	}
+	checkLastWrite(3, 0, 3)
+
+	stop, err = cpu.ReverseContinue(context.Background(), RunOptions{})
+	if err != nil || stop.Reason != StopHistoryStart || stop.PC != TextOffset {
+		t.Errorf("ReverseContinue to the start = %+v, %v", stop, err)
+	}
+	if _, ok := cpu.LastWrite(value); ok {
+		t.Error("LastWrite found a write at the start of the history")
+	}
+}
@@ -0,0 +1,122 @@
+package simleg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+)
+
+// include parses the rest of an .include directive and continues parsing
+// from the start of the named file. Relative paths are taken from the
+// directory of the including file.
+func (p *Parser) include() error {
+	t, err := p.expect(itemString)
+	if err != nil {
+		return fmt.Errorf("file name: %v", err)
+	}
+	name, err := strconv.Unquote(t)
+	if err != nil {
+		return fmt.Errorf("bad file name %s", t)
+	}
+	if !p.has(itemNewline) && !p.has(itemEOF) {
+		return fmt.Errorf("unexpected token '%s' after file name", p.peek().text)
+	}
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(filepath.Dir(p.l.name), name)
+	}
+	path, err := filepath.Abs(name)
+	if err != nil {
+		return err
+	}
+	for _, l := range append(p.stack, p.l) {
+		if l.path == path {
+			return fmt.Errorf("%s includes itself", name)
+		}
+	}
+	if len(p.stack) >= maxExpansionDepth {
+		return errors.New("includes nested too deeply")
+	}
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	p.pk = nil // the file takes the place of the end of the line
+	l := lex(name, string(b))
+	l.path = path
+	p.stack = append(p.stack, p.l)
+	p.l = l
+	return nil
+}
+
+// ParseFiles parses the files at paths into one program that starts with
+// the first file. Labels are local to the file that defines them, and
+// the files it includes, unless it declares them with .global. When there
+// are several files, local labels are renamed label$N, where N numbers
+// the file from 1, so that they do not clash with each other or with any
+// label a file can define. Errors are reported as by
+// ParseAll, except that ParseFiles stops if a file cannot be read.
+func (p *Parser) ParseFiles(paths ...string) (Program, error) {
+	var prog Program
+	var errs ErrorList
+	for i, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		p.Filename = path
+		p.Use(bytes.NewReader(b))
+		start := len(prog)
+		prog, errs = p.parseSource(prog, errs)
+		n := 0
+		if len(paths) > 1 {
+			n = i + 1
+		}
+		errs = append(errs, p.localize(prog[start:], n)...)
+	}
+	return p.finish(prog, errs)
+}
+
+// localize checks that the labels prog declares .global are defined, and
+// if n is not 0 renames the others to label$n. prog is the part of
+// a program parsed from one file.
+func (p *Parser) localize(prog Program, n int) (errs ErrorList) {
+	globals := make(map[string]Pos)
+	for _, as := range prog {
+		if as.Op == ".global" {
+			globals[as.To.Label] = as.Pos
+		}
+	}
+	defined := make(map[string]bool)
+	for _, as := range prog {
+		if as.Label == "" {
+			continue
+		}
+		defined[as.Label] = true
+		if _, ok := globals[as.Label]; !ok && n != 0 {
+			p.scope.rename[as.Label] = fmt.Sprintf("%s$%d", as.Label, n)
+		}
+	}
+	for name, pos := range globals {
+		if !defined[name] {
+			errs = append(errs, &ParseError{Pos: pos, Msg: fmt.Sprintf("%s declared .global but not defined", name)})
+		}
+	}
+	rename := func(label string) string {
+		if r, ok := p.scope.rename[label]; ok {
+			return r
+		}
+		return label
+	}
+	for i := range prog {
+		as := &prog[i]
+		as.Label = rename(as.Label)
+		if _, ok := directives[as.Op]; !ok {
+			as.To.Label = rename(as.To.Label)
+			as.From.Label = rename(as.From.Label)
+		}
+	}
+	return errs
+}
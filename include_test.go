@@ -0,0 +1,56 @@
+package simleg
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var includeFiles = map[string]string{
+	"main.asm":   "\tBL sum\nloop:\tB loop.1\n",
+	"sum.asm":    ".global sum\n.global loop.1\nsum:\tADD X0,X0,X1\nloop:\tCBNZ X0,loop\nloop.1:\tBR LR\n",
+	"local.asm":  "\tB loop\n",
+	"global.asm": ".global missing\n\tBR LR\n",
+	"a.asm":      ".include \"b.asm\"\n",
+	"b.asm":      "\tBR LR\n.include \"a.asm\"\n",
+	"self.asm":   ".include \"self.asm\"\n",
+}
+
+var includeTests = []struct {
+	files []string
+	want  string // instructions, or the error
+}{
+	{[]string{"main.asm", "sum.asm"}, "BL sum; loop$1: B loop.1; .global sum; .global loop.1; sum: ADD X0,X0,X1; loop$2: CBNZ X0,loop$2; loop.1: BR X30"},
+	{[]string{"sum.asm", "main.asm"}, ".global sum; .global loop.1; sum: ADD X0,X0,X1; loop$1: CBNZ X0,loop$1; loop.1: BR X30; BL sum; loop$2: B loop.1"},
+	{[]string{"local.asm", "sum.asm"}, "B loop: undefined label 'loop'"},
+	{[]string{"global.asm"}, "global.asm:1:1: missing declared .global but not defined"},
+	{[]string{"a.asm"}, "b.asm:2:10: a.asm includes itself"},
+	{[]string{"self.asm"}, "self.asm:1:10: self.asm includes itself"},
+}
+
+func TestParseFiles(t *testing.T) {
+	dir := writeFiles(t, includeFiles)
+	for _, tt := range includeTests {
+		var paths []string
+		for _, name := range tt.files {
+			paths = append(paths, filepath.Join(dir, name))
+		}
+		p := &Parser{}
+		prog, err := p.ParseFiles(paths...)
+		if err == nil {
+			// branches to labels are only resolved when encoding
+			_, err = prog.Encode()
+		}
+		var got []string
+		for _, as := range prog {
+			got = append(got, as.String())
+		}
+		if err != nil {
+			got = []string{err.Error()}
+		}
+		s := strings.ReplaceAll(strings.Join(got, "; "), dir+string(filepath.Separator), "")
+		if s != tt.want {
+			t.Errorf("%v = %s, want %s", tt.files, s, tt.want)
+		}
+	}
+}
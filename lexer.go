@@ -9,7 +9,7 @@ import (
 )
 
 func Lex(input string) {
-	l := lex(input)
+	l := lex("", input)
 
 	for i := l.nextItem(); i.typ != itemEOF; {
 		fmt.Println(i)
@@ -34,33 +34,90 @@ const (
 	itemComma  // ,
 	itemLbrack // [
 	itemRbrack // ]
+	itemNewline
+	itemString   // "quoted"
+	itemHash     // #
+	itemLparen   // (
+	itemRparen   // )
+	itemOperator // + - * / % << >> & | ^ ~
 )
 
+// Pos is a position in a source file.
+type Pos struct {
+	File string
+	Line int // starting at 1
+	Col  int // starting at 1, in runes
+}
+
+// IsValid reports whether the position is known.
+func (p Pos) IsValid() bool {
+	return p.Line > 0
+}
+
+// String returns the position as file:line:col, omitting the file if it
+// is unknown.
+func (p Pos) String() string {
+	if !p.IsValid() {
+		return "-"
+	}
+	s := fmt.Sprintf("%d:%d", p.Line, p.Col)
+	if p.File != "" {
+		s = p.File + ":" + s
+	}
+	return s
+}
+
 type item struct {
 	typ  itemType
 	text string
+	pos  Pos
+	off  int // byte offset in the input
 }
 
 type lexer struct {
-	mu    sync.RWMutex
-	input string
-	start int
-	pos   int
-	width int
-	state stateFn
-	items chan item
+	mu        sync.RWMutex
+	name      string // file name used in positions
+	input     string
+	start     int
+	pos       int
+	width     int
+	line      int // line number of start
+	lineStart int // offset of the first byte of line
+	state     stateFn
+	items     chan item
+	path      string // absolute path of the file being read, if any
 }
 
-// lex creates a new scanner for the input string.
-func lex(input string) *lexer {
+// lex creates a new scanner for the input string. name is
+// used in the positions of the items it produces.
+func lex(name, input string) *lexer {
 	l := &lexer{
+		name:  name,
 		input: input,
+		line:  1,
 		state: lexInput,
 		items: make(chan item, 2), // Two items sufficient.
 	}
 	return l
 }
 
+// position returns the position of start.
+func (l *lexer) position() Pos {
+	col := utf8.RuneCountInString(l.input[l.lineStart:l.start]) + 1
+	return Pos{File: l.name, Line: l.line, Col: col}
+}
+
+// advance moves start up to pos, counting the lines passed over.
+func (l *lexer) advance() {
+	for i := l.start; i < l.pos; i++ {
+		if l.input[i] == '\n' {
+			l.line++
+			l.lineStart = i + 1
+		}
+	}
+	l.start = l.pos
+}
+
 // run lexes the input by executing state functions until
 // the state is nil.
 func (l *lexer) run() {
@@ -73,6 +130,9 @@ func (l *lexer) run() {
 // nextItem returns the next item from the input.
 func (l *lexer) nextItem() item {
 	for {
+		if l.state == nil {
+			return item{itemEOF, "", l.position(), l.start}
+		}
 		select {
 		case item := <-l.items:
 			return item
@@ -90,34 +150,59 @@ func lexInput(l *lexer) stateFn {
 		case r == eof:
 			l.emit(itemEOF)
 			return nil
-		case unicode.IsSpace(r):
-			l.ignore()
 		case r == '\n':
+			l.emit(itemNewline)
+			return lexInput
+		case unicode.IsSpace(r):
 			l.ignore()
 		case r == ';':
 			l.ignoreLine()
 		case r == ':':
 			l.emit(itemColon)
+			return lexInput
 		case r == ',':
 			l.emit(itemComma)
+			return lexInput
 		case r == '[':
 			l.emit(itemLbrack)
+			return lexInput
 		case r == ']':
 			l.emit(itemRbrack)
+			return lexInput
+		case r == '(':
+			l.emit(itemLparen)
+			return lexInput
+		case r == ')':
+			l.emit(itemRparen)
+			return lexInput
+		case r == '#':
+			l.emit(itemHash)
+			return lexInput
 		case r == '/':
 			if nr := l.next(); nr == '/' {
 				l.ignoreLine()
 				break
 			}
-			return l.errorf("unexpected '%c'", r)
-		case r == '#':
-			if nr := l.next(); unicode.IsDigit(nr) {
-				l.backup() // digit
-				l.backup() // #
-				return lexInteger
+			l.backup()
+			l.emit(itemOperator)
+			return lexInput
+		case r == '<' || r == '>':
+			if nr := l.next(); nr != r {
+				l.backup()
+				return l.errorf("unexpected '%c'", r)
 			}
-			return l.errorf("missing digit")
-		case unicode.IsLetter(r):
+			l.emit(itemOperator)
+			return lexInput
+		case strings.ContainsRune("+-*%&|^~", r):
+			l.emit(itemOperator)
+			return lexInput
+		case r == '"':
+			l.backup()
+			return lexString
+		case r == '\'':
+			l.backup()
+			return lexChar
+		case isNameStart(r):
 			l.backup()
 			return lexName
 		case unicode.IsDigit(r):
@@ -129,37 +214,133 @@ func lexInput(l *lexer) stateFn {
 	}
 }
 
+func isNameStart(r rune) bool {
+	return unicode.IsLetter(r) || r == '_' || r == '.'
+}
+
+func isNameRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+// lexName scans an opcode, register, label or directive.
 func lexName(l *lexer) stateFn {
-	l.acceptRange(unicode.IsLetter, unicode.IsDigit)
+	l.accept(".") // might be a directive
+	l.acceptRange(isNameRune)
 	l.accept(".") // might be a B.?
-	l.acceptRange(unicode.IsLetter, unicode.IsDigit)
+	l.acceptRange(isNameRune)
 	l.emit(itemName)
 	return lexInput
 }
 
+// lexInteger scans a decimal, hexadecimal (0x) or binary (0b) integer.
 func lexInteger(l *lexer) stateFn {
-	l.accept("#") // optional hash
-	l.acceptRange(unicode.IsDigit)
+	digits := "0123456789"
+	if l.accept("0") {
+		switch {
+		case l.accept("xX"):
+			digits = "0123456789abcdefABCDEF"
+		case l.accept("bB"):
+			digits = "01"
+		}
+	}
+	l.acceptRun(digits)
+	if r := l.peek(); unicode.IsLetter(r) || unicode.IsDigit(r) {
+		l.next()
+		return l.errorf("bad number syntax: %s", l.input[l.start:l.pos])
+	}
 	l.emit(itemInteger)
 	return lexInput
 }
 
-// error returns an error token and terminates the scan
-// by passing back a nil pointer that will be the next
-// state, terminating l.run.
+// lexString scans a double-quoted string, which may contain escapes.
+func lexString(l *lexer) stateFn {
+	l.accept("\"")
+	for {
+		switch l.next() {
+		case '\\':
+			if r := l.next(); r != eof && r != '\n' {
+				break
+			}
+			fallthrough
+		case eof, '\n':
+			l.backup()
+			return l.errorf("unterminated string")
+		case '"':
+			l.emit(itemString)
+			return lexInput
+		}
+	}
+}
+
+// lexChar scans a quoted character literal, which may be escaped.
+func lexChar(l *lexer) stateFn {
+	l.accept("'")
+	for {
+		switch l.next() {
+		case '\\':
+			if r := l.next(); r != eof && r != '\n' {
+				break
+			}
+			fallthrough
+		case eof, '\n':
+			l.backup()
+			return l.errorf("unterminated character literal")
+		case '\'':
+			l.emit(itemInteger)
+			return lexInput
+		}
+	}
+}
+
+// errorf returns an error token, skips the offending input
+// and carries on scanning so the parser can recover.
 func (l *lexer) errorf(format string, args ...interface{}) stateFn {
 	l.items <- item{
 		itemError,
 		fmt.Sprintf(format, args...),
+		l.position(),
+		l.start,
 	}
-	return nil
+	l.ignore()
+	return lexInput
 }
 
 func (l *lexer) emit(t itemType) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	l.items <- item{t, l.input[l.start:l.pos]}
-	l.start = l.pos
+	l.items <- item{t, l.input[l.start:l.pos], l.position(), l.start}
+	l.advance()
+}
+
+// rest returns the input from offset off to the end of its line, and
+// carries on scanning at the newline. off must be on the current line.
+func (l *lexer) rest(off int) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	end := len(l.input)
+	if i := strings.IndexByte(l.input[off:], '\n'); i >= 0 {
+		end = off + i
+	}
+	l.pos, l.start = end, end
+	return l.input[off:end]
+}
+
+// nextLine returns the raw text of the line at pos, and moves past it.
+// It reports false at the end of the input.
+func (l *lexer) nextLine() (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.pos >= len(l.input) {
+		return "", false
+	}
+	s := l.input[l.pos:]
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		s = s[:i]
+		l.pos++
+	}
+	l.pos += len(s)
+	l.advance()
+	return s, true
 }
 
 // next returns the next rune in the input.
@@ -179,18 +360,15 @@ func (l *lexer) next() (r rune) {
 func (l *lexer) ignore() {
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	l.start = l.pos
+	l.advance()
 }
 
+// ignoreLine skips the rest of the line, up to the newline.
 func (l *lexer) ignoreLine() {
-	var r rune
-	for r = l.next(); !(r == '\n' || r == eof); {
-		r = l.next()
-	}
-	if r == eof {
-		l.backup()
+	for r := l.next(); r != '\n' && r != eof; r = l.next() {
 	}
-	l.start = l.pos
+	l.backup()
+	l.ignore()
 }
 
 // backup steps back one rune.
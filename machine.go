@@ -1 +1,68 @@
 package simleg
+
+import "fmt"
+
+// StackSize is the stack space given to each core of a Machine.
+const StackSize = 0x10000
+
+// Machine runs several CPUs that share one Memory, interleaving their
+// instructions one at a time.
+type Machine struct {
+	CPUs   []*CPU
+	Memory *Memory
+
+	running []bool
+}
+
+// NewMachine returns a Machine with n cores.
+func NewMachine(n int) *Machine {
+	m := &Machine{Memory: &Memory{}}
+	for i := 0; i < n; i++ {
+		m.CPUs = append(m.CPUs, &CPU{Memory: m.Memory})
+	}
+	return m
+}
+
+// Load loads prog onto every core. Each core gets its own stack, and X0
+// holds its core number.
+func (m *Machine) Load(prog Program) error {
+	return m.load(prog, (*CPU).Load)
+}
+
+// LoadText is like Load, but every core fetches its instructions from the
+// text segment of the shared Memory.
+func (m *Machine) LoadText(prog Program) error {
+	return m.load(prog, (*CPU).LoadText)
+}
+
+func (m *Machine) load(prog Program, load func(*CPU, Program) error) error {
+	m.running = make([]bool, len(m.CPUs))
+	for i, cpu := range m.CPUs {
+		if err := load(cpu, prog); err != nil {
+			return err
+		}
+		cpu.Registers[X0] = uint64(i)
+		cpu.Registers[SP] = StackOffset - uint64(i)*StackSize
+		m.running[i] = true
+	}
+	return nil
+}
+
+// Step runs one instruction on each core that is still running, in order,
+// and reports whether any core is still running. It stops at the first
+// core that fails.
+func (m *Machine) Step() (bool, error) {
+	running := false
+	for i, cpu := range m.CPUs {
+		if !m.running[i] {
+			continue
+		}
+		var err error
+		m.running[i], err = cpu.Step()
+		if err != nil {
+			return false, fmt.Errorf("cpu %d: %w", i, err)
+		}
+		running = running || m.running[i]
+	}
+	return running, nil
+}
@@ -0,0 +1,76 @@
+package simleg
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+)
+
+// Each row runs LDXR on core 0, then store on core 1, then STXR on core 0.
+var exclusiveTests = []struct {
+	store  string
+	status uint64
+}{
+	{"ADD X2,X2,X2", 0},
+	{"STUR X2,[X20,#0]", 1},
+	{"STUR X2,[X20,#8]", 1},
+	{"STURB X2,[X20,#15]", 1},
+	{"STUR X2,[X20,#16]", 0},
+	{"LDUR X2,[X20,#0]", 0},
+}
+
+func TestExclusive(t *testing.T) {
+	const addr = 0x600000
+	for _, tt := range exclusiveTests {
+		m := NewMachine(2)
+		cores := []string{"LDXR X1,[X20,#0]\nSTXR X3,X4,[X20,#0]", tt.store}
+		for i, src := range cores {
+			cpu := m.CPUs[i]
+			if err := cpu.Load(parse(t, src)); err != nil {
+				t.Fatal(err)
+			}
+			cpu.Registers[X20] = addr
+			cpu.Registers[X2] = 2
+			cpu.Registers[X3] = 3
+		}
+		for _, i := range []int{0, 1, 0} {
+			if _, err := m.CPUs[i].Step(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := m.CPUs[0].Registers[X4]; got != tt.status {
+			t.Errorf("%s: STXR status = %d, want %d", tt.store, got, tt.status)
+		}
+		var b [8]byte
+		m.Memory.Read(b[:], addr)
+		stored := binary.LittleEndian.Uint64(b[:]) == 3
+		if stored != (tt.status == 0) {
+			t.Errorf("%s: STXR stored = %v", tt.store, stored)
+		}
+	}
+}
+
+func TestSpinlock(t *testing.T) {
+	src, err := ioutil.ReadFile("test/0005_spinlock.asm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMachine(4)
+	if err := m.Load(parse(t, string(src))); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		running, err := m.Step()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !running {
+			break
+		}
+	}
+	var b [8]byte
+	m.Memory.Read(b[:], 0x600008)
+	if got := binary.LittleEndian.Uint64(b[:]); got != 400 {
+		t.Errorf("counter = %d, want 400", got)
+	}
+}
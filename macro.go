@@ -0,0 +1,195 @@
+package simleg
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxExpansionDepth limits how deeply macros may expand into other macros.
+const maxExpansionDepth = 64
+
+type macro struct {
+	params []string
+	body   string
+	pos    Pos // of the first line of the body
+}
+
+// define parses the rest of a .macro directive, and records the lines up
+// to the matching .endm as the body of the macro.
+func (p *Parser) define() error {
+	name, err := p.expect(itemName)
+	if err != nil {
+		return fmt.Errorf("macro name: %v", err)
+	}
+	if _, ok := lookupFormat(name); ok {
+		return fmt.Errorf("%s is already an opcode", name)
+	}
+	m := &macro{}
+	for !p.has(itemNewline) && !p.has(itemEOF) {
+		if len(m.params) > 0 {
+			if _, err := p.expect(itemComma); err != nil {
+				return err
+			}
+		}
+		param, err := p.expect(itemName)
+		if err != nil {
+			return fmt.Errorf("parameter: %v", err)
+		}
+		for _, q := range m.params {
+			if q == param {
+				return fmt.Errorf("duplicate parameter %s", param)
+			}
+		}
+		m.params = append(m.params, param)
+	}
+	if _, err := p.expect(itemNewline); err != nil {
+		return fmt.Errorf("%s: missing .endm", name)
+	}
+	m.pos = p.l.position()
+	var body []string
+	for depth := 0; ; {
+		line, ok := p.l.nextLine()
+		if !ok {
+			return fmt.Errorf("%s: missing .endm", name)
+		}
+		if f := strings.Fields(stripComment(line)); len(f) > 0 {
+			switch f[0] {
+			case ".macro":
+				depth++
+			case ".endm":
+				depth--
+			}
+		}
+		if depth < 0 {
+			break
+		}
+		body = append(body, line)
+	}
+	if p.macros == nil {
+		p.macros = make(map[string]*macro)
+	}
+	p.macros[name] = m
+	m.body = strings.Join(body, "\n") + "\n"
+	return nil
+}
+
+// expand parses the arguments of a macro invocation and continues parsing
+// from the expanded body. A label on the invocation labels the first
+// instruction of the expansion.
+func (p *Parser) expand(m *macro, as Instruction) error {
+	if len(p.stack) >= maxExpansionDepth {
+		return errors.New("macro expansion too deep")
+	}
+	var rest string
+	if t := p.peek(); t.typ != itemNewline && t.typ != itemEOF {
+		p.pk = nil
+		rest = p.l.rest(t.off)
+	}
+	args := splitArgs(stripComment(rest))
+	if len(args) != len(m.params) {
+		return fmt.Errorf("macro takes %d arguments, got %d", len(m.params), len(args))
+	}
+	p.pk = nil // the expansion takes the place of the end of the line
+	p.expansions++
+	n := strconv.Itoa(p.expansions)
+	if as.Label != "" {
+		p.label, p.labelPos = as.Label, as.Pos
+	}
+	var sb strings.Builder
+	s := m.body
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			sb.WriteByte(s[i])
+			continue
+		}
+		name := s[i+1:]
+		for j, r := range name {
+			if !isNameRune(r) {
+				name = name[:j]
+				break
+			}
+		}
+		switch {
+		case strings.HasPrefix(s[i+1:], "@"):
+			// unique for each expansion, for local labels
+			sb.WriteString(n)
+			i++
+		case strings.HasPrefix(s[i+1:], "()"):
+			// separates a parameter from the text after it
+			i += 2
+		case name != "" && indexOf(m.params, name) >= 0:
+			sb.WriteString(args[indexOf(m.params, name)])
+			i += len(name)
+		default:
+			sb.WriteByte(s[i]) // a string escape, say
+		}
+	}
+	l := lex(m.pos.File, sb.String())
+	l.line = m.pos.Line
+	p.stack = append(p.stack, p.l)
+	p.l = l
+	return nil
+}
+
+func indexOf(a []string, s string) int {
+	for i := range a {
+		if a[i] == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// stripComment removes a trailing // or ; comment from a line.
+func stripComment(line string) string {
+	quote := byte(0)
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ';', c == '/' && strings.HasPrefix(line[i:], "//"):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// splitArgs splits the arguments of a macro invocation at the commas that
+// are not inside brackets, parentheses or quotes.
+func splitArgs(s string) []string {
+	if strings.TrimSpace(s) == "" {
+		return nil
+	}
+	var args []string
+	depth, quote, start := 0, byte(0), 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[' || c == '(':
+			depth++
+		case c == ']' || c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			args = append(args, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	return append(args, strings.TrimSpace(s[start:]))
+}
@@ -0,0 +1,70 @@
+package simleg
+
+import (
+	"strings"
+	"testing"
+)
+
+const testMacros = `
+.macro count r
+loop\@:	SUBI \r,\r,#1
+	CBNZ \r,loop\@
+.endm
+.macro op name, r, rn
+	\name \r,\rn,\r
+	\name\()S \r,\r,\rn
+.endm
+.macro inc r
+	ADDI \r,\r,#1
+.endm
+.macro nothing
+.endm
+.macro rec
+	rec
+.endm
+`
+
+var macroTests = []struct {
+	src  string
+	want string // instructions, or the error
+}{
+	{"count X1\ncount X2", "loop1: SUBI X1,X1,#1; CBNZ X1,loop1; loop2: SUBI X2,X2,#1; CBNZ X2,loop2"},
+	{"op ADD, X1, X2", "ADD X1,X2,X1; ADDS X1,X1,X2"},
+	{"op SUB, X3, X4 // comment", "SUB X3,X4,X3; SUBS X3,X3,X4"},
+	{"start: inc X1\nB start", "start: ADDI X1,X1,#1; B start"},
+	{"start: nothing\n\tinc X2", "start: ADDI X2,X2,#1"},
+	{"start: nothing", "test.asm:18:1: start labels an empty expansion"},
+	{"start: count X1", "test.asm:3:1: start and loop1 label the same instruction"},
+	{"inc X1, X2", "test.asm:18:1: macro takes 1 arguments, got 2"},
+	{"rec", "test.asm:16:2: macro expansion too deep"},
+}
+
+func TestMacros(t *testing.T) {
+	for _, tt := range macroTests {
+		p := &Parser{Filename: "test.asm"}
+		p.Use(strings.NewReader(testMacros + tt.src))
+		prog, err := p.ParseAll()
+		var got []string
+		for _, as := range prog {
+			got = append(got, as.String())
+		}
+		if err != nil {
+			got = []string{err.Error()}
+		}
+		if s := strings.Join(got, "; "); s != tt.want {
+			t.Errorf("%s = %s, want %s", tt.src, s, tt.want)
+		}
+	}
+}
+
+func TestMacroPositions(t *testing.T) {
+	p := &Parser{Filename: "test.asm"}
+	p.Use(strings.NewReader(testMacros + "start: inc X1"))
+	prog, err := p.ParseAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := prog[0].Pos.String(); got != "test.asm:11:2" {
+		t.Errorf("%s at %s, want the ADDI in the body of inc at test.asm:11:2", prog[0], got)
+	}
+}
@@ -14,9 +14,86 @@ func init() {
 
 const BlockSize = 1 << 10 // 1KB
 
+// ReservationGranule is the size of the aligned block that LDXR reserves.
+const ReservationGranule = 16
+
 type Memory struct {
 	mu     sync.Mutex
 	blocks map[uint64]*memoryBlock
+
+	// exclusive monitor: the granule each CPU has reserved with LDXR
+	monitor  sync.Mutex
+	reserved map[*CPU]uint64
+
+	hooksMu sync.Mutex
+	hooks   []memoryHook // replaced, never modified, so it can be read unlocked
+	nhooks  int
+}
+
+// AccessKind is whether an Access reads or writes memory.
+type AccessKind uint8
+
+const (
+	AccessRead AccessKind = 1 << iota
+	AccessWrite
+)
+
+func (k AccessKind) String() string {
+	switch k {
+	case AccessRead:
+		return "read"
+	case AccessWrite:
+		return "write"
+	}
+	return "access"
+}
+
+// An Access is a load or store made by a CPU running a program. Data holds
+// the bytes read, or those about to be written, and is only valid during
+// the call to a hook.
+type Access struct {
+	CPU  *CPU
+	Kind AccessKind
+	Addr uint64
+	Data []byte
+}
+
+type memoryHook struct {
+	id int
+	fn func(a Access)
+}
+
+// Hook calls fn for each access a CPU makes to m, until the returned
+// function is called to remove it. Reads are reported after they happen
+// and writes before, so fn may read the old contents. fn must not write
+// to m.
+func (m *Memory) Hook(fn func(a Access)) (remove func()) {
+	m.hooksMu.Lock()
+	defer m.hooksMu.Unlock()
+	m.nhooks++
+	id := m.nhooks
+	m.hooks = append(m.hooks[:len(m.hooks):len(m.hooks)], memoryHook{id, fn})
+	return func() {
+		m.hooksMu.Lock()
+		defer m.hooksMu.Unlock()
+		var hooks []memoryHook
+		for _, h := range m.hooks {
+			if h.id != id {
+				hooks = append(hooks, h)
+			}
+		}
+		m.hooks = hooks
+	}
+}
+
+// notify passes a to the hooks of m.
+func (m *Memory) notify(a Access) {
+	m.hooksMu.Lock()
+	hooks := m.hooks
+	m.hooksMu.Unlock()
+	for _, h := range hooks {
+		h.fn(a)
+	}
 }
 
 func (m *Memory) getOrMakeBlock(addr uint64) (b *memoryBlock) {
@@ -49,7 +126,16 @@ func (m *Memory) Read(b []byte, addr uint64) (n uint64, err error) {
 	return n, nil
 }
 
+// Write stores b at addr, clearing any exclusive reservations on the
+// granules it touches.
 func (m *Memory) Write(b []byte, addr uint64) (n uint64, err error) {
+	m.monitor.Lock()
+	defer m.monitor.Unlock()
+	m.clearReservations(addr, uint64(len(b)))
+	return m.write(b, addr)
+}
+
+func (m *Memory) write(b []byte, addr uint64) (n uint64, err error) {
 	total := uint64(len(b))
 	for n < total {
 		bk := m.getOrMakeBlock(addr + n)
@@ -63,6 +149,73 @@ func (m *Memory) Write(b []byte, addr uint64) (n uint64, err error) {
 	return n, nil
 }
 
+// loadExclusive reads b from addr and reserves addr's granule for cpu.
+func (m *Memory) loadExclusive(cpu *CPU, b []byte, addr uint64) (n uint64, err error) {
+	m.monitor.Lock()
+	defer m.monitor.Unlock()
+	if m.reserved == nil {
+		m.reserved = make(map[*CPU]uint64)
+	}
+	m.reserved[cpu] = addr / ReservationGranule
+	n, err = m.Read(b, addr)
+	m.notify(Access{cpu, AccessRead, addr, b})
+	return n, err
+}
+
+// storeExclusive writes b to addr only if cpu still holds the reservation
+// on addr's granule, and reports whether it did. The reservation is
+// released either way.
+func (m *Memory) storeExclusive(cpu *CPU, b []byte, addr uint64) (bool, error) {
+	m.monitor.Lock()
+	defer m.monitor.Unlock()
+	g, ok := m.reserved[cpu]
+	delete(m.reserved, cpu)
+	if !ok || g != addr/ReservationGranule {
+		return false, nil
+	}
+	m.clearReservations(addr, uint64(len(b)))
+	m.notify(Access{cpu, AccessWrite, addr, b})
+	_, err := m.write(b, addr)
+	return err == nil, err
+}
+
+// reservation returns the granule cpu has reserved, if any.
+func (m *Memory) reservation(cpu *CPU) (g uint64, ok bool) {
+	m.monitor.Lock()
+	defer m.monitor.Unlock()
+	g, ok = m.reserved[cpu]
+	return g, ok
+}
+
+// reserve reserves granule g for cpu, or releases its reservation if ok
+// is false.
+func (m *Memory) reserve(cpu *CPU, g uint64, ok bool) {
+	m.monitor.Lock()
+	defer m.monitor.Unlock()
+	if !ok {
+		delete(m.reserved, cpu)
+		return
+	}
+	if m.reserved == nil {
+		m.reserved = make(map[*CPU]uint64)
+	}
+	m.reserved[cpu] = g
+}
+
+// clearReservations releases every reservation on the granules that
+// overlap n bytes at addr. The caller must hold m.monitor.
+func (m *Memory) clearReservations(addr, n uint64) {
+	if n == 0 {
+		return
+	}
+	first, last := addr/ReservationGranule, (addr+n-1)/ReservationGranule
+	for cpu, g := range m.reserved {
+		if g >= first && g <= last {
+			delete(m.reserved, cpu)
+		}
+	}
+}
+
 type memoryBlock struct {
 	off  uint64
 	data [BlockSize]byte
@@ -0,0 +1,565 @@
+package simleg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// An Object is a separately assembled module: its machine code and data,
+// the labels it defines, and the places that refer to addresses only known
+// once it is linked with Link.
+type Object struct {
+	Name    string
+	Text    []byte
+	Data    []byte
+	Symbols []Symbol
+	Relocs  []Reloc
+}
+
+// Section is the part of an Object a symbol or relocation belongs to.
+type Section uint8
+
+const (
+	SectionText Section = iota
+	SectionData
+)
+
+// A Symbol is a label defined by an Object. Its Value is relative to the
+// start of its section.
+type Symbol struct {
+	Name    string
+	Section Section
+	Value   uint64
+	Global  bool // declared .global, so other objects may refer to it
+}
+
+type RelocKind uint8
+
+const (
+	RelocNone     RelocKind = iota
+	RelocBranch26           // B and BL
+	RelocBranch19           // B.cond, CBZ and CBNZ
+	RelocAddr32             // the MOVZ and MOVK of LDA
+	RelocWord               // .word
+	RelocDword              // .dword
+)
+
+var relocNames = [...]string{"none", "branch26", "branch19", "addr32", "word", "dword"}
+
+func (k RelocKind) String() string {
+	if int(k) < len(relocNames) {
+		return relocNames[k]
+	}
+	return fmt.Sprintf("RelocKind(%d)", k)
+}
+
+// section returns the section a relocation of kind k patches.
+func (k RelocKind) section() Section {
+	if k == RelocWord || k == RelocDword {
+		return SectionData
+	}
+	return SectionText
+}
+
+// A Reloc asks the linker to patch the value of Symbol plus Addend in at
+// Offset, which is relative to the start of the section the kind patches.
+// The symbols ".text" and ".data" stand for the start of the object's own
+// sections.
+type Reloc struct {
+	Kind   RelocKind
+	Offset uint64
+	Symbol string
+	Addend int64
+}
+
+// A relocSite is where an expression's value goes in an object, should
+// it be an address.
+type relocSite struct {
+	kind RelocKind
+	off  int // into the Data of the instruction
+}
+
+// A fixupReloc is a relocation found while resolving a fixup, before the
+// address of its instruction is known.
+type fixupReloc struct {
+	index  int // of the instruction in the program
+	site   relocSite
+	base   string
+	addend int64
+}
+
+// relocation splits the value of e into a base symbol, which is "" if the
+// value does not depend on where anything is linked, and an addend. Labels
+// are taken relative to the section they are in, and names that are not
+// defined are left for the linker.
+func relocation(e expr, s *scope, labels map[string]uint64) (base string, addend int64, err error) {
+	bases := make(map[string]bool)
+	eval := func(moved string, by int64) (int64, error) {
+		return e.eval(func(name string) (int64, bool) {
+			if n, ok := s.symbols[name]; ok {
+				return n, true
+			}
+			if r, ok := s.rename[name]; ok {
+				name = r
+			}
+			b, n := name, int64(0)
+			if addr, ok := labels[name]; ok {
+				b, n = ".text", int64(addr-TextOffset)
+				if addr >= DataOffset {
+					b, n = ".data", int64(addr-DataOffset)
+				}
+			}
+			bases[b] = true
+			if b == moved {
+				n += by
+			}
+			return n, true
+		})
+	}
+	addend, err = eval("", 0)
+	if err != nil {
+		return "", 0, err
+	}
+	// the value must move along with exactly one base, or none
+	for b := range bases {
+		var moves []bool
+		for _, by := range []int64{1, 1 << 32} {
+			n, err := eval(b, by)
+			if err != nil {
+				return "", 0, err
+			}
+			if n != addend && n != addend+by {
+				return "", 0, errors.New("not relocatable")
+			}
+			moves = append(moves, n != addend)
+		}
+		if moves[0] != moves[1] {
+			return "", 0, errors.New("not relocatable")
+		}
+		if moves[0] {
+			if base != "" {
+				return "", 0, errors.New("not relocatable")
+			}
+			base = b
+		}
+	}
+	return base, addend, nil
+}
+
+// relocate records a relocation for f if its value depends on where the
+// object is linked, and reports whether it did.
+func (p *Parser) relocate(f fixup, labels map[string]uint64) (bool, error) {
+	base, addend, err := relocation(f.e, f.scope, labels)
+	if err != nil || base == "" {
+		return false, err
+	}
+	if f.site.kind == RelocNone {
+		return false, fmt.Errorf("%s is not known until link time", base)
+	}
+	p.relocs = append(p.relocs, fixupReloc{f.index, f.site, base, addend})
+	return true, nil
+}
+
+// ParseObject parses the rest of the input into an Object, reporting
+// errors as ParseAll does. Branches to labels the input does not define,
+// and addresses in LDA, .word and .dword, are left for Link to fill in.
+func (p *Parser) ParseObject() (*Object, error) {
+	p.object, p.relocs = true, nil
+	defer func() { p.object = false }()
+	prog, errs := p.parseSource(nil, nil)
+	errs = append(errs, p.localize(prog, 0)...)
+	_, _, _, addrs := prog.place()
+	globals := make(map[string]bool)
+	for _, as := range prog {
+		if as.Op == ".global" {
+			globals[as.To.Label] = true
+		}
+	}
+	prog, err := p.finish(prog, errs)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &Object{Name: p.Filename}
+	labels, text, data := prog.layout()
+	o.Text, err = text.encode(labels, func(i int, as *Instruction) error {
+		kind := RelocBranch19
+		if as.Op == "B" || as.Op == "BL" {
+			kind = RelocBranch26
+		}
+		o.Relocs = append(o.Relocs, Reloc{Kind: kind, Offset: 4 * uint64(i), Symbol: as.To.Label})
+		as.To = Addr{}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	o.Data = data
+	for _, r := range p.relocs {
+		off := addrs[r.index] - TextOffset
+		if r.site.kind.section() == SectionData {
+			off = addrs[r.index] - DataOffset + uint64(r.site.off)
+		}
+		o.Relocs = append(o.Relocs, Reloc{Kind: r.site.kind, Offset: off, Symbol: r.base, Addend: r.addend})
+	}
+	p.relocs = nil
+	for name, addr := range labels {
+		sym := Symbol{Name: name, Value: addr - TextOffset, Global: globals[name]}
+		if addr >= DataOffset {
+			sym.Section, sym.Value = SectionData, addr-DataOffset
+		}
+		o.Symbols = append(o.Symbols, sym)
+	}
+	o.sort()
+	return o, nil
+}
+
+// sort puts the symbols and relocations of o in address order.
+func (o *Object) sort() {
+	sort.Slice(o.Symbols, func(i, j int) bool {
+		a, b := o.Symbols[i], o.Symbols[j]
+		if a.Section != b.Section {
+			return a.Section < b.Section
+		}
+		return a.Value < b.Value || a.Value == b.Value && a.Name < b.Name
+	})
+	sort.Slice(o.Relocs, func(i, j int) bool {
+		a, b := o.Relocs[i], o.Relocs[j]
+		if a.Kind.section() != b.Kind.section() {
+			return a.Kind.section() < b.Kind.section()
+		}
+		return a.Offset < b.Offset
+	})
+}
+
+// dataAlign is the alignment of each object's data in a linked object.
+const dataAlign = 16
+
+// Link merges objs into one object with no relocations left, laid out in
+// order from TextOffset and DataOffset. A relocation refers to a symbol of
+// its own object if there is one, and otherwise to a global symbol of any
+// object. When there are several objects, their local symbols are renamed
+// name$N, where N numbers the object from 1. Undefined and duplicate
+// global symbols are reported together.
+func Link(objs ...*Object) (*Object, error) {
+	out := &Object{}
+	if len(objs) > 0 {
+		out.Name = objs[0].Name
+	}
+	var errs []string
+	textBase := make([]uint64, len(objs))
+	dataBase := make([]uint64, len(objs))
+	globals := make(map[string]int) // to the object defining them
+	addrs := make([]map[string]uint64, len(objs))
+	for i, o := range objs {
+		for len(out.Data)%dataAlign != 0 {
+			out.Data = append(out.Data, 0)
+		}
+		textBase[i], dataBase[i] = uint64(len(out.Text)), uint64(len(out.Data))
+		out.Text = append(out.Text, o.Text...)
+		out.Data = append(out.Data, o.Data...)
+		addrs[i] = map[string]uint64{
+			".text": TextOffset + textBase[i],
+			".data": DataOffset + dataBase[i],
+		}
+		for _, sym := range o.Symbols {
+			s := sym
+			if s.Section == SectionText {
+				s.Value += textBase[i]
+				addrs[i][s.Name] = TextOffset + s.Value
+			} else {
+				s.Value += dataBase[i]
+				addrs[i][s.Name] = DataOffset + s.Value
+			}
+			if s.Global {
+				if j, ok := globals[s.Name]; ok {
+					errs = append(errs, fmt.Sprintf("%s defined in both %s and %s", s.Name, objs[j].Name, o.Name))
+					continue
+				}
+				globals[s.Name] = i
+			} else if len(objs) > 1 {
+				s.Name = fmt.Sprintf("%s$%d", s.Name, i+1)
+			}
+			out.Symbols = append(out.Symbols, s)
+		}
+	}
+	for i, o := range objs {
+		for _, r := range o.Relocs {
+			target, ok := addrs[i][r.Symbol]
+			if j, global := globals[r.Symbol]; !ok && global {
+				target, ok = addrs[j][r.Symbol], true
+			}
+			if !ok {
+				errs = append(errs, fmt.Sprintf("%s: undefined symbol '%s'", o.Name, r.Symbol))
+				continue
+			}
+			base := textBase[i]
+			if r.Kind.section() == SectionData {
+				base = dataBase[i]
+			}
+			if err := out.patch(r, base, target+uint64(r.Addend)); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %s relocation at %#x: %v", o.Name, r.Kind, r.Offset, err))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.New(strings.Join(errs, "\n"))
+	}
+	out.sort()
+	return out, nil
+}
+
+// patch applies r, for an object whose section starts at base in o, with
+// the value v.
+func (o *Object) patch(r Reloc, base, v uint64) error {
+	off := base + r.Offset
+	b := o.Text
+	size := uint64(4)
+	switch r.Kind {
+	case RelocAddr32:
+		size = 8
+	case RelocWord:
+		b = o.Data
+	case RelocDword:
+		b, size = o.Data, 8
+	}
+	if off+size > uint64(len(b)) {
+		return errors.New("offset out of range")
+	}
+	switch r.Kind {
+	case RelocBranch26, RelocBranch19:
+		if v < TextOffset || v >= DataOffset {
+			return fmt.Errorf("branch to %#x, outside the text segment", v)
+		}
+		if v%4 != 0 {
+			return fmt.Errorf("branch to misaligned address %#x", v)
+		}
+		n, shift := uint(26), uint(0)
+		if r.Kind == RelocBranch19 {
+			n, shift = 19, 5
+		}
+		field, err := branchOffset(Addr{Offset: int64(v-TextOffset-off) / 4}, n)
+		if err != nil {
+			return err
+		}
+		w := binary.LittleEndian.Uint32(b[off:])
+		mask := uint32(1<<n-1) << shift
+		binary.LittleEndian.PutUint32(b[off:], w&^mask|field<<shift)
+	case RelocAddr32:
+		if v >= 1<<32 {
+			return fmt.Errorf("address %#x does not fit in 32 bits", v)
+		}
+		for i, imm := range []uint64{v & 0xFFFF, v >> 16} {
+			p := b[off+4*uint64(i):]
+			w := binary.LittleEndian.Uint32(p)
+			binary.LittleEndian.PutUint32(p, w&^(0xFFFF<<5)|uint32(imm)<<5)
+		}
+	case RelocWord:
+		if v >= 1<<32 {
+			return fmt.Errorf("address %#x does not fit in 4 bytes", v)
+		}
+		binary.LittleEndian.PutUint32(b[off:], uint32(v))
+	case RelocDword:
+		binary.LittleEndian.PutUint64(b[off:], v)
+	default:
+		return errors.New("unknown kind")
+	}
+	return nil
+}
+
+// Program returns the instructions and data of a linked object, labelled
+// with its symbols.
+func (o *Object) Program() (Program, error) {
+	if len(o.Relocs) > 0 {
+		return nil, fmt.Errorf("%s: %d relocations left, link it first", o.Name, len(o.Relocs))
+	}
+	text, err := Disassemble(o.Text)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", o.Name, err)
+	}
+	names := [2]map[uint64][]string{{}, {}}
+	for _, s := range o.Symbols {
+		names[s.Section][s.Value] = append(names[s.Section][s.Value], s.Name)
+	}
+
+	var prog Program
+	// label puts the first name at off on as and the rest on section
+	// directives before it, which label the same address.
+	label := func(sec Section, off uint64, as Instruction) {
+		dir := Instruction{Op: ".text"}
+		if sec == SectionData {
+			dir.Op = ".data"
+		}
+		for i, name := range names[sec][off] {
+			if i == len(names[sec][off])-1 && as.Op != "" {
+				as.Label = name
+				break
+			}
+			dir.Label = name
+			prog = append(prog, dir)
+		}
+		if as.Op != "" {
+			prog = append(prog, as)
+		}
+	}
+	for i, as := range text {
+		label(SectionText, 4*uint64(i), as)
+	}
+	label(SectionText, uint64(len(o.Text)), Instruction{})
+
+	if len(o.Data) == 0 {
+		return prog, nil
+	}
+	prog = append(prog, Instruction{Op: ".data"})
+	var cuts []uint64
+	for off := range names[SectionData] {
+		if off < uint64(len(o.Data)) {
+			cuts = append(cuts, off)
+		}
+	}
+	sort.Slice(cuts, func(i, j int) bool { return cuts[i] < cuts[j] })
+	cuts = append(cuts, uint64(len(o.Data)))
+	start := uint64(0)
+	for _, off := range cuts {
+		if off > start {
+			label(SectionData, start, Instruction{Op: ".byte", Data: o.Data[start:off]})
+			start = off
+		}
+	}
+	label(SectionData, uint64(len(o.Data)), Instruction{})
+	return prog, nil
+}
+
+// objectMagic starts each object file, followed by the format version.
+const (
+	objectMagic   = "SLGO"
+	objectVersion = 1
+)
+
+// WriteTo writes o to w in the object file format read by ReadObject.
+func (o *Object) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	var tmp [binary.MaxVarintLen64]byte
+	uvarint := func(n uint64) { buf.Write(tmp[:binary.PutUvarint(tmp[:], n)]) }
+	field := func(b []byte) {
+		uvarint(uint64(len(b)))
+		buf.Write(b)
+	}
+	buf.WriteString(objectMagic)
+	buf.WriteByte(objectVersion)
+	field([]byte(o.Name))
+	field(o.Text)
+	field(o.Data)
+	uvarint(uint64(len(o.Symbols)))
+	for _, s := range o.Symbols {
+		field([]byte(s.Name))
+		buf.WriteByte(byte(s.Section))
+		uvarint(s.Value)
+		global := byte(0)
+		if s.Global {
+			global = 1
+		}
+		buf.WriteByte(global)
+	}
+	uvarint(uint64(len(o.Relocs)))
+	for _, r := range o.Relocs {
+		buf.WriteByte(byte(r.Kind))
+		uvarint(r.Offset)
+		field([]byte(r.Symbol))
+		buf.Write(tmp[:binary.PutVarint(tmp[:], r.Addend)])
+	}
+	n, err := w.Write(buf.Bytes())
+	return int64(n), err
+}
+
+// maxObjectField limits the size of each field ReadObject reads.
+const maxObjectField = 1 << 28
+
+// ReadObject reads an object written by Object.WriteTo.
+func ReadObject(r io.Reader) (*Object, error) {
+	br := bufio.NewReader(r)
+	var err error
+	fail := func(e error) {
+		if err == nil {
+			err = e
+		}
+	}
+	uvarint := func() uint64 {
+		n, e := binary.ReadUvarint(br)
+		fail(e)
+		return n
+	}
+	readByte := func() byte {
+		c, e := br.ReadByte()
+		fail(e)
+		return c
+	}
+	readBytes := func() []byte {
+		n := uvarint()
+		if err != nil {
+			return nil
+		}
+		if n > maxObjectField {
+			fail(fmt.Errorf("field of %d bytes is too large", n))
+			return nil
+		}
+		b := make([]byte, n)
+		_, e := io.ReadFull(br, b)
+		fail(e)
+		return b
+	}
+	count := func() int {
+		n := uvarint()
+		if n > maxObjectField {
+			fail(fmt.Errorf("%d entries is too many", n))
+			return 0
+		}
+		return int(n)
+	}
+
+	magic := make([]byte, len(objectMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != objectMagic {
+		return nil, errors.New("not an object file")
+	}
+	if v := readByte(); err == nil && v != objectVersion {
+		return nil, fmt.Errorf("unsupported object version %d", v)
+	}
+	o := &Object{}
+	o.Name = string(readBytes())
+	o.Text = readBytes()
+	o.Data = readBytes()
+	for n := count(); n > 0 && err == nil; n-- {
+		var s Symbol
+		s.Name = string(readBytes())
+		s.Section = Section(readByte())
+		s.Value = uvarint()
+		s.Global = readByte() != 0
+		if s.Section > SectionData {
+			fail(fmt.Errorf("symbol %s: unknown section %d", s.Name, s.Section))
+		}
+		o.Symbols = append(o.Symbols, s)
+	}
+	for n := count(); n > 0 && err == nil; n-- {
+		var rel Reloc
+		rel.Kind = RelocKind(readByte())
+		rel.Offset = uvarint()
+		rel.Symbol = string(readBytes())
+		addend, e := binary.ReadVarint(br)
+		fail(e)
+		rel.Addend = addend
+		o.Relocs = append(o.Relocs, rel)
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading object: %v", err)
+	}
+	return o, nil
+}
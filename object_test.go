@@ -0,0 +1,213 @@
+package simleg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// assemble parses src, from the file name, into an Object.
+func assemble(t *testing.T, name, src string) *Object {
+	t.Helper()
+	p := &Parser{Filename: name}
+	p.Use(strings.NewReader(src))
+	o, err := p.ParseObject()
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return o
+}
+
+const mainObject = `
+	MOV X19,LR
+	LDA X9,ptrs
+	LDUR X10,[X9,#0]
+	LDUR X0,[X10,#0]
+	LDUR X1,[X10,#8]
+	CBNZ XZR,sum
+	BL sum
+	LDUR X10,[X9,#8]
+	LDURSW X2,[X10,#0]
+	LDURSW X3,[X9,#16]
+	B done
+	ADDI X0,XZR,#1
+done:	MOV LR,X19
+	BR LR
+	.data
+ptrs:	.dword table,size
+	.word ptrs+4
+`
+
+const libObject = `
+	.global sum
+	.global table
+	.global size
+sum:	ADD X0,X0,X1
+	CBZ X0,done
+	ADDI X0,X0,#0
+done:	BR LR
+	.data
+size:	.word 2
+table:	.dword 5,7
+`
+
+func TestLink(t *testing.T) {
+	main := assemble(t, "main.asm", mainObject)
+	lib := assemble(t, "lib.asm", libObject)
+	kinds := make(map[RelocKind]bool)
+	for _, r := range main.Relocs {
+		kinds[r.Kind] = true
+	}
+	for _, k := range []RelocKind{RelocBranch26, RelocBranch19, RelocAddr32, RelocWord, RelocDword} {
+		if !kinds[k] {
+			t.Errorf("main.asm has no %s relocation", k)
+		}
+	}
+	if len(lib.Relocs) != 0 {
+		t.Errorf("lib.asm has relocations %v", lib.Relocs)
+	}
+
+	o, err := Link(main, lib)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(o.Relocs) != 0 {
+		t.Errorf("relocations %v left", o.Relocs)
+	}
+	addrs := make(map[string]uint64)
+	for _, s := range o.Symbols {
+		addrs[s.Name] = s.Value
+	}
+	for _, name := range []string{"done$1", "done$2", "ptrs$1", "sum", "table", "size"} {
+		if _, ok := addrs[name]; !ok {
+			t.Errorf("no symbol %s in %v", name, o.Symbols)
+		}
+	}
+	prog, err := o.Program()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cpu CPU
+	if err := cpu.Load(prog); err != nil {
+		t.Fatal(err)
+	}
+	cpu.Registers[LR] = cpu.textEnd
+	for {
+		running, err := cpu.Step()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !running {
+			break
+		}
+	}
+	ptrs := DataOffset + addrs["ptrs$1"]
+	want := [4]uint64{12, 7, 2, ptrs + 4}
+	if got := [4]uint64{cpu.Registers[X0], cpu.Registers[X1], cpu.Registers[X2], cpu.Registers[X3]}; got != want {
+		t.Errorf("X0-X3 = %v, want %v", got, want)
+	}
+}
+
+func TestLinkErrors(t *testing.T) {
+	a := assemble(t, "a.asm", ".global f\nf:\tBL g\n\tLDA X1,h\n")
+	b := assemble(t, "b.asm", ".global f\nf:\tBR LR\n")
+	_, err := Link(a, b)
+	want := "f defined in both a.asm and b.asm\na.asm: undefined symbol 'g'\na.asm: undefined symbol 'h'"
+	if err == nil || err.Error() != want {
+		t.Errorf("Link = %v, want\n%s", err, want)
+	}
+}
+
+// Each row links a CB-format or B branch to far, which is offset bytes
+// after the branch. far is in the next object if that is big enough.
+var patchTests = []struct {
+	kind   RelocKind
+	offset uint64
+	err    string
+}{
+	{RelocBranch19, 4 * (1<<18 - 1), ""},
+	{RelocBranch19, 4 << 18, "branch offset 262144 does not fit in 19 bits"},
+	{RelocBranch26, 4 << 18, ""},
+	{RelocBranch19, 2, "branch to misaligned address 0x400002"},
+	{RelocBranch26, 1 << 28, "outside the text segment"},
+}
+
+func TestPatchBranch(t *testing.T) {
+	for _, tt := range patchTests {
+		op := Instruction{Op: "CBZ", From: Addr{Reg: X1}}
+		if tt.kind == RelocBranch26 {
+			op.Op = "B"
+		}
+		w, err := op.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		a := &Object{Name: "a", Text: make([]byte, 4), Relocs: []Reloc{{Kind: tt.kind, Symbol: "far"}}}
+		binary.LittleEndian.PutUint32(a.Text, w)
+		b := &Object{Name: "b", Text: make([]byte, 4<<18)}
+		if far := (Symbol{Name: "far", Value: tt.offset - 4, Global: true}); tt.offset < 4 || tt.offset > 4<<18 {
+			far.Value = tt.offset
+			a.Symbols = []Symbol{far}
+		} else {
+			b.Symbols = []Symbol{far}
+		}
+		o, err := Link(a, b)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s to %#x: %v, want %s", tt.kind, tt.offset, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s to %#x: %v", tt.kind, tt.offset, err)
+			continue
+		}
+		as, err := Decode(binary.LittleEndian.Uint32(o.Text))
+		if err != nil || as.Op != op.Op || 4*uint64(as.To.Offset) != tt.offset {
+			t.Errorf("%s to %#x patched to %s, %v", tt.kind, tt.offset, as, err)
+		}
+	}
+}
+
+func TestObjectRoundTrip(t *testing.T) {
+	o := assemble(t, "main.asm", mainObject)
+	var buf bytes.Buffer
+	n, err := o.WriteTo(&buf)
+	if err != nil || n != int64(buf.Len()) {
+		t.Fatalf("WriteTo = %d, %v, for %d bytes", n, err, buf.Len())
+	}
+	b := buf.Bytes()
+	got, err := ReadObject(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, o) {
+		t.Errorf("read back\n%+v\nwant\n%+v", got, o)
+	}
+
+	for i := range b {
+		if _, err := ReadObject(bytes.NewReader(b[:i])); err == nil {
+			t.Errorf("read an object cut to %d of %d bytes", i, len(b))
+		}
+	}
+	corrupt := func(i int, c byte) []byte {
+		b := append([]byte(nil), b...)
+		b[i] = c
+		return b
+	}
+	for _, tt := range []struct {
+		b   []byte
+		err string
+	}{
+		{corrupt(0, 'X'), "not an object file"},
+		{corrupt(len(objectMagic), 9), "unsupported object version 9"},
+		// the length of the name, as a varint
+		{append(b[:len(objectMagic)+1:len(objectMagic)+1], 0xFF, 0xFF, 0xFF, 0xFF, 0x7F), "too large"},
+	} {
+		if _, err := ReadObject(bytes.NewReader(tt.b)); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("ReadObject = %v, want %s", err, tt.err)
+		}
+	}
+}
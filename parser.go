@@ -1,15 +1,88 @@
 package simleg
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"unicode/utf8"
 )
 
+// ParseError reports a syntax error at a source position.
+type ParseError struct {
+	Pos Pos
+	Msg string
+}
+
+func (e *ParseError) Error() string {
+	return e.Pos.String() + ": " + e.Msg
+}
+
+// ErrorList is a list of parse errors in source order.
+type ErrorList []*ParseError
+
+func (l ErrorList) Error() string {
+	switch len(l) {
+	case 0:
+		return "no errors"
+	case 1:
+		return l[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more errors)", l[0], len(l)-1)
+}
+
+// Err returns l as an error, or nil if l is empty.
+func (l ErrorList) Err() error {
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
+
 type Parser struct {
-	l  *lexer
-	pk *item
+	// Filename is used in the positions of parsed instructions and errors.
+	Filename string
+
+	l      *lexer
+	pk     *item
+	last   item // most recently consumed item
+	inData bool // in the data section
+	scope  *scope
+	fixups []fixup // expressions waiting for symbols defined later
+
+	queue []Instruction // rest of an expanded pseudo-instruction
+
+	object bool         // assembling an Object, see ParseObject
+	relocs []fixupReloc // relocations found while resolving fixups
+
+	macros     map[string]*macro
+	stack      []*lexer // lexers suspended by macro expansions
+	expansions int      // number of macro expansions so far
+	label      string   // label of a macro invocation, for its first instruction
+	labelPos   Pos
+}
+
+// A fixup is an expression that could not be evaluated when it was parsed.
+// ParseAll evaluates it once every symbol is known and passes the value to
+// set along with the instruction it belongs to.
+type fixup struct {
+	e     expr
+	pos   Pos
+	scope *scope
+	index int // of the instruction in the program
+	site  relocSite
+	what  string
+	set   func(as *Instruction, n int64) error
+}
+
+// A scope holds the names defined by one source file.
+type scope struct {
+	symbols map[string]int64  // defined by .equ and .set
+	rename  map[string]string // local labels and their names in the program
 }
 
 func (p *Parser) Use(r io.Reader) error {
@@ -17,21 +90,47 @@ func (p *Parser) Use(r io.Reader) error {
 	if err != nil {
 		return err
 	}
-	p.l = lex(string(b))
+	p.l = lex(p.Filename, string(b))
+	if p.Filename != "" {
+		p.l.path, _ = filepath.Abs(p.Filename)
+	}
+	p.pk = nil
+	p.inData = false
+	p.scope = &scope{symbols: make(map[string]int64), rename: make(map[string]string)}
+	p.macros = nil
+	p.stack = nil
+	p.queue = nil
+	p.label = ""
 	return nil
 }
 
+// lexItem returns the next item from the input, resuming the source of
+// a macro invocation or .include at the end of the expansion or file.
+func (p *Parser) lexItem() item {
+	t := p.l.nextItem()
+	for t.typ == itemEOF && len(p.stack) > 0 {
+		p.l = p.stack[len(p.stack)-1]
+		p.stack = p.stack[:len(p.stack)-1]
+		t = p.l.nextItem()
+	}
+	return t
+}
+
 func (p *Parser) nextItem() item {
 	if p.pk != nil {
-		i := *p.pk
+		p.last = *p.pk
 		p.pk = nil
-		return i
+		return p.last
 	}
-	return p.l.nextItem()
+	p.last = p.lexItem()
+	return p.last
 }
 
 func (p *Parser) peek() item {
-	i := p.l.nextItem()
+	if p.pk != nil {
+		return *p.pk
+	}
+	i := p.lexItem()
 	p.pk = &i
 	return i
 }
@@ -39,7 +138,13 @@ func (p *Parser) peek() item {
 func (p *Parser) expect(typ itemType) (string, error) {
 	t := p.nextItem()
 	if t.typ == itemEOF {
-		return "", io.EOF
+		return "", errors.New("unexpected end of input")
+	}
+	if t.typ == itemError {
+		return "", errors.New(t.text)
+	}
+	if t.typ == itemNewline && typ != itemNewline {
+		return "", errors.New("unexpected newline")
 	}
 	if t.typ != typ {
 		return "", fmt.Errorf("unexpected token '%s'", t.text)
@@ -51,33 +156,265 @@ func (p *Parser) has(typ itemType) bool {
 	return p.peek().typ == typ
 }
 
-func (p *Parser) Next() (as Instruction, err error) {
-	name, err := p.expect(itemName)
+// Next parses the next instruction. It returns io.EOF at the end of the
+// input, and a *ParseError for invalid input. Pseudo-instructions are
+// returned one real instruction at a time. Expressions must only refer
+// to symbols defined by earlier .equ or .set directives; use ParseAll for
+// labels and forward references.
+func (p *Parser) Next() (Instruction, error) {
+	if len(p.queue) > 0 {
+		as := p.queue[0]
+		p.queue = p.queue[1:]
+		return as, nil
+	}
+	as, err := p.next()
+	if err == nil && len(p.fixups) > 0 {
+		f := p.fixups[0]
+		p.fixups = nil
+		_, err = f.e.eval(lookup(p.scope, nil))
+		return as, &ParseError{Pos: f.pos, Msg: fmt.Sprintf("%s: %v", f.what, err)}
+	}
 	if err != nil {
 		return as, err
 	}
+	prog := as.expand()
+	p.queue = prog[1:]
+	return prog[0], nil
+}
+
+func (p *Parser) next() (as Instruction, err error) {
+	for {
+		p.skipNewlines()
+		t := p.peek()
+		if t.typ == itemEOF && p.label != "" {
+			label := p.label
+			p.label = ""
+			return as, &ParseError{Pos: p.labelPos, Msg: fmt.Sprintf("%s labels an empty expansion", label)}
+		}
+		if t.typ == itemEOF {
+			return as, io.EOF
+		}
+		as = Instruction{Pos: t.pos}
+		ok, err := p.parse(&as)
+		if err != nil {
+			return as, &ParseError{Pos: p.last.pos, Msg: err.Error()}
+		}
+		if !ok {
+			continue // a macro was defined or expanded
+		}
+		if p.label != "" {
+			label := p.label
+			p.label = ""
+			if as.Label != "" {
+				return as, &ParseError{Pos: as.Pos, Msg: fmt.Sprintf("%s and %s label the same instruction", label, as.Label)}
+			}
+			as.Label = label
+		}
+		if t := p.nextItem(); t.typ != itemNewline && t.typ != itemEOF {
+			return as, &ParseError{Pos: t.pos, Msg: fmt.Sprintf("unexpected token '%s' after instruction", t.text)}
+		}
+		return as, nil
+	}
+}
+
+// ParseAll parses the rest of the input. After an error it skips to the
+// next line and carries on, so it returns every instruction that parsed
+// along with an ErrorList of everything that did not. Expressions that
+// refer to labels or to symbols defined further on are evaluated at the
+// end, once the program is laid out, and then pseudo-instructions are
+// expanded.
+func (p *Parser) ParseAll() (Program, error) {
+	prog, errs := p.parseSource(nil, nil)
+	errs = append(errs, p.localize(prog, 0)...)
+	return p.finish(prog, errs)
+}
+
+// parseSource appends the rest of the input to prog, and its errors to
+// errs.
+func (p *Parser) parseSource(prog Program, errs ErrorList) (Program, ErrorList) {
+	for ; len(p.queue) > 0; p.queue = p.queue[1:] {
+		prog = append(prog, p.queue[0])
+	}
+	start := len(prog)
+	for {
+		n := len(p.fixups)
+		as, err := p.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			errs = append(errs, err.(*ParseError))
+			p.fixups = p.fixups[:n]
+			p.skipLine()
+			continue
+		}
+		for i := n; i < len(p.fixups); i++ {
+			p.fixups[i].index = len(prog)
+		}
+		prog = append(prog, as)
+	}
+	for _, as := range prog[start:] {
+		if _, ok := p.scope.symbols[as.Label]; ok {
+			errs = append(errs, &ParseError{Pos: as.Pos, Msg: fmt.Sprintf("%s redefined", as.Label)})
+		}
+	}
+	return prog, errs
+}
+
+// finish resolves the fixups of prog and expands its pseudo-instructions.
+func (p *Parser) finish(prog Program, errs ErrorList) (Program, error) {
+	errs = append(errs, p.resolve(prog)...)
+	var expanded Program
+	for _, as := range prog {
+		expanded = append(expanded, as.expand()...)
+	}
+	sort.SliceStable(errs, func(i, j int) bool {
+		a, b := errs[i].Pos, errs[j].Pos
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		return a.Line < b.Line || a.Line == b.Line && a.Col < b.Col
+	})
+	return expanded, errs.Err()
+}
+
+// lookup returns a function that looks up the symbols of s and then
+// labels, taking local labels by their names in the program.
+func lookup(s *scope, labels map[string]uint64) func(string) (int64, bool) {
+	return func(name string) (int64, bool) {
+		if n, ok := s.symbols[name]; ok {
+			return n, true
+		}
+		if r, ok := s.rename[name]; ok {
+			name = r
+		}
+		n, ok := labels[name]
+		return int64(n), ok
+	}
+}
+
+// resolve evaluates the pending fixups of prog. A fixup may wait on
+// a symbol defined by another one, so they are retried until no more
+// progress is made.
+func (p *Parser) resolve(prog Program) (errs ErrorList) {
+	labels, _, _ := prog.layout()
+	seen := make(map[string]bool)
+	for _, as := range prog {
+		if as.Label == "" {
+			continue
+		}
+		if seen[as.Label] {
+			errs = append(errs, &ParseError{Pos: as.Pos, Msg: fmt.Sprintf("%s redefined", as.Label)})
+		}
+		seen[as.Label] = true
+	}
+	for progress := true; progress; {
+		progress = false
+		pending := p.fixups[:0]
+		for _, f := range p.fixups {
+			n, err := f.e.eval(lookup(f.scope, labels))
+			if _, ok := err.(undefinedError); ok {
+				pending = append(pending, f)
+				continue
+			}
+			progress = true
+			if err == nil && p.object {
+				var linked bool
+				if linked, err = p.relocate(f, labels); linked {
+					continue
+				}
+			}
+			if err == nil {
+				err = f.set(&prog[f.index], n)
+			}
+			if err != nil {
+				errs = append(errs, &ParseError{Pos: f.pos, Msg: fmt.Sprintf("%s: %v", f.what, err)})
+			}
+		}
+		p.fixups = pending
+	}
+	for _, f := range p.fixups {
+		_, err := f.e.eval(lookup(f.scope, labels))
+		if p.object {
+			// the symbol is left for the linker to find
+			linked, rerr := p.relocate(f, labels)
+			if linked {
+				continue
+			}
+			if rerr != nil {
+				err = rerr
+			}
+		}
+		errs = append(errs, &ParseError{Pos: f.pos, Msg: fmt.Sprintf("%s: %v", f.what, err)})
+	}
+	p.fixups = nil
+	return errs
+}
+
+func (p *Parser) skipNewlines() {
+	for p.has(itemNewline) {
+		p.nextItem()
+	}
+}
+
+// skipLine discards the rest of the current line.
+func (p *Parser) skipLine() {
+	for t := p.last; t.typ != itemNewline && t.typ != itemEOF; {
+		t = p.nextItem()
+	}
+}
+
+// parse parses an instruction and its optional label. It reports false
+// if the line defined or invoked a macro instead.
+func (p *Parser) parse(as *Instruction) (bool, error) {
+	name, err := p.expect(itemName)
+	if err != nil {
+		return false, err
+	}
 	if p.has(itemColon) {
 		p.expect(itemColon)
 		as.Label = name
+		p.skipNewlines() // a label may sit on a line of its own
 		op, err := p.expect(itemName)
 		if err != nil {
-			return as, err
+			return false, err
 		}
 		as.Op = op
 	} else {
 		as.Op = name
 	}
-	f, ok := opcodes[as.Op]
+	switch as.Op {
+	case ".macro":
+		if as.Label != "" {
+			return false, errors.New(".macro cannot be labelled")
+		}
+		return false, p.define()
+	case ".endm":
+		return false, errors.New(".endm without .macro")
+	case ".include":
+		if as.Label != "" {
+			return false, errors.New(".include cannot be labelled")
+		}
+		return false, p.include()
+	}
+	if m, ok := p.macros[as.Op]; ok {
+		return false, p.expand(m, *as)
+	}
+	f, ok := lookupFormat(as.Op)
 	if !ok {
-		return as, fmt.Errorf("opcode not supported: %s", as.Op)
+		return false, fmt.Errorf("opcode not supported: %s", as.Op)
+	}
+	_, directive := directives[as.Op]
+	switch {
+	case isData(as.Op) && !p.inData:
+		return false, fmt.Errorf("%s outside of .data", as.Op)
+	case !directive && p.inData:
+		return false, fmt.Errorf("instruction %s in .data", as.Op)
 	}
 	if f.p == nil {
 		panic("opcode: " + as.Op + " missing parser")
 	}
-	if err = f.p(p, &as); err != nil {
-		return as, err
-	}
-	return as, nil
+	return true, f.p(p, as)
 }
 
 type formatParser func(p *Parser, as *Instruction) error
@@ -108,6 +445,25 @@ func rformatParser(p *Parser, as *Instruction) (err error) {
 	return nil
 }
 
+func fcformatString(w io.Writer, as Instruction) {
+	fmt.Fprintf(w, "%s,%s", as.From.Reg, as.Reg)
+}
+
+func fcformatParser(p *Parser, as *Instruction) (err error) {
+	as.From.Reg, err = p.expectRegister(as.registerPrefix())
+	if err != nil {
+		return fmt.Errorf("first operand: %v", err)
+	}
+	if _, err = p.expect(itemComma); err != nil {
+		return err
+	}
+	as.Reg, err = p.expectRegister(as.registerPrefix())
+	if err != nil {
+		return fmt.Errorf("second operand: %v", err)
+	}
+	return nil
+}
+
 func dformatString(w io.Writer, as Instruction) {
 	fmt.Fprintf(w, "%s,", as.To.Reg)
 	offsetString(w, as.From)
@@ -121,8 +477,34 @@ func dformatParser(p *Parser, as *Instruction) (err error) {
 	if _, err = p.expect(itemComma); err != nil {
 		return err
 	}
-	as.From, err = p.expectOffset(as)
+	if err = p.expectOffset(as); err != nil {
+		return fmt.Errorf("from: %v", err)
+	}
+	return nil
+}
+
+// xformatString prints STXR, whose status register follows the value.
+func xformatString(w io.Writer, as Instruction) {
+	fmt.Fprintf(w, "%s,%s,", as.To.Reg, as.Reg)
+	offsetString(w, as.From)
+}
+
+func xformatParser(p *Parser, as *Instruction) (err error) {
+	as.To.Reg, err = p.expectRegister(as.registerPrefix())
 	if err != nil {
+		return fmt.Errorf("to: %v", err)
+	}
+	if _, err = p.expect(itemComma); err != nil {
+		return err
+	}
+	as.Reg, err = p.expectRegister(as.registerPrefix())
+	if err != nil {
+		return fmt.Errorf("status: %v", err)
+	}
+	if _, err = p.expect(itemComma); err != nil {
+		return err
+	}
+	if err = p.expectOffset(as); err != nil {
 		return fmt.Errorf("from: %v", err)
 	}
 	return nil
@@ -147,19 +529,38 @@ func iformatParser(p *Parser, as *Instruction) (err error) {
 	if _, err = p.expect(itemComma); err != nil {
 		return err
 	}
-	as.Imm, err = p.expectImmediate(16)
-	if err != nil {
-		return fmt.Errorf("immediate: %v", err)
-	}
-	return nil
+	return p.expectValue(as, "immediate", setIformatImm)
+}
+
+func setIformatImm(as *Instruction, n int64) (err error) {
+	bits := 12
+	if as.Op == "LSL" || as.Op == "LSR" {
+		bits = 6
+	} else if neg, ok := negatedOps[as.Op]; ok && n < 0 {
+		// adding a negative number is subtracting a positive one
+		as.Op, n = neg, -n
+	}
+	as.Imm, err = checkUnsigned(n, bits)
+	return err
+}
+
+// negatedOps pairs the arithmetic immediate instructions that undo each
+// other, for rewriting negative immediates.
+var negatedOps = map[string]string{
+	"ADDI":  "SUBI",
+	"ADDIS": "SUBIS",
+	"SUBI":  "ADDI",
+	"SUBIS": "ADDIS",
+	"CMPI":  "CMNI",
+	"CMNI":  "CMPI",
 }
 
 func bformatString(w io.Writer, as Instruction) {
-	if as.To.Label != "" {
-		fmt.Fprint(w, as.To.Label)
+	if as.Op == "BR" {
+		fmt.Fprint(w, as.To.Reg)
 		return
 	}
-	fmt.Fprint(w, as.To.Offset)
+	addrString(w, as.To)
 }
 
 func bformatParser(p *Parser, as *Instruction) (err error) {
@@ -178,7 +579,8 @@ func bformatParser(p *Parser, as *Instruction) (err error) {
 }
 
 func cbformatString(w io.Writer, as Instruction) {
-	fmt.Fprintf(w, "%s,%s", as.From.Reg, as.To.Label)
+	fmt.Fprintf(w, "%s,", as.From.Reg)
+	addrString(w, as.To)
 }
 
 func cbformatParser(p *Parser, as *Instruction) (err error) {
@@ -189,7 +591,7 @@ func cbformatParser(p *Parser, as *Instruction) (err error) {
 	if _, err = p.expect(itemComma); err != nil {
 		return err
 	}
-	as.To.Label, err = p.expect(itemName)
+	as.To, err = p.expectAddr(as)
 	if err != nil {
 		return fmt.Errorf("to: %v", err)
 	}
@@ -198,6 +600,9 @@ func cbformatParser(p *Parser, as *Instruction) (err error) {
 
 func iwformatString(w io.Writer, as Instruction) {
 	fmt.Fprintf(w, "%s,#%d", as.To.Reg, as.Imm)
+	if as.Shift != 0 {
+		fmt.Fprintf(w, ",LSL #%d", as.Shift)
+	}
 }
 
 func iwformatParser(p *Parser, as *Instruction) (err error) {
@@ -208,24 +613,133 @@ func iwformatParser(p *Parser, as *Instruction) (err error) {
 	if _, err = p.expect(itemComma); err != nil {
 		return err
 	}
-	as.Imm, err = p.expectImmediate(32)
+	err = p.expectValue(as, "immediate", func(as *Instruction, n int64) (err error) {
+		as.Imm, err = checkUnsigned(n, 16)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !p.has(itemComma) {
+		return nil
+	}
+	p.expect(itemComma)
+	if t, err := p.expect(itemName); err != nil || t != "LSL" {
+		return fmt.Errorf("expecting LSL")
+	}
+	shift, err := p.expectImmediate(6)
 	if err != nil {
-		return fmt.Errorf("immediate: %v", err)
+		return fmt.Errorf("shift: %v", err)
+	}
+	switch shift {
+	case 0, 16, 32, 48:
+		as.Shift = uint8(shift)
+	default:
+		return fmt.Errorf("shift must be 0, 16, 32 or 48")
 	}
 	return nil
 }
 
-func (p *Parser) expectImmediate(bitsize int) (uint64, error) {
-	imm, err := p.expect(itemInteger)
+// parseNumber parses an integer or character literal as produced by
+// lexInteger and lexChar. Integers up to 1<<64-1 wrap around to negative
+// values.
+func parseNumber(s string) (int64, error) {
+	if strings.HasPrefix(s, "'") {
+		c, err := strconv.Unquote(s)
+		if err != nil || utf8.RuneCountInString(c) != 1 {
+			return 0, fmt.Errorf("bad character literal %s", s)
+		}
+		r, _ := utf8.DecodeRuneInString(c)
+		return int64(r), nil
+	}
+	digits, base := s, 10
+	switch {
+	case strings.HasPrefix(digits, "0x"), strings.HasPrefix(digits, "0X"):
+		base, digits = 16, digits[2:]
+	case strings.HasPrefix(digits, "0b"), strings.HasPrefix(digits, "0B"):
+		base, digits = 2, digits[2:]
+	}
+	n, err := strconv.ParseUint(digits, base, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad number %s", s)
+	}
+	return int64(n), nil
+}
+
+// expectConst parses an expression that can be evaluated right away.
+func (p *Parser) expectConst() (int64, error) {
+	e, err := p.parseExpr()
+	if err != nil {
+		return 0, err
+	}
+	return e.eval(lookup(p.scope, nil))
+}
+
+// expectValue parses an expression and passes its value to set. If the
+// expression refers to a symbol that is not defined yet, set is called
+// by ParseAll once it is. Errors are prefixed with what.
+func (p *Parser) expectValue(as *Instruction, what string, set func(as *Instruction, n int64) error) error {
+	return p.expectAddress(as, what, relocSite{}, set)
+}
+
+// expectAddress is like expectValue, but the value may be an address
+// that an Object relocates at site.
+func (p *Parser) expectAddress(as *Instruction, what string, site relocSite, set func(as *Instruction, n int64) error) error {
+	pos := p.peek().pos
+	e, err := p.parseExpr()
 	if err != nil {
-		return 0, fmt.Errorf("not an integer: %v", err)
+		return fmt.Errorf("%s: %v", what, err)
+	}
+	return p.setValue(as, e, pos, what, site, set)
+}
+
+// setValue evaluates e, parsed at pos, and passes its value to set, or
+// leaves that to ParseAll if e refers to a symbol not defined yet.
+func (p *Parser) setValue(as *Instruction, e expr, pos Pos, what string, site relocSite, set func(as *Instruction, n int64) error) error {
+	n, err := e.eval(lookup(p.scope, nil))
+	if _, ok := err.(undefinedError); ok {
+		p.fixups = append(p.fixups, fixup{e: e, pos: pos, scope: p.scope, site: site, what: what, set: set})
+		return nil
 	}
-	if imm[0] == '#' {
-		imm = imm[1:]
+	if err == nil {
+		err = set(as, n)
 	}
-	n, err := strconv.ParseUint(imm, 10, 32)
 	if err != nil {
-		return 0, fmt.Errorf("%v", err)
+		return fmt.Errorf("%s: %v", what, err)
+	}
+	return nil
+}
+
+// expectImmediate parses an unsigned immediate that fits in bitsize bits.
+func (p *Parser) expectImmediate(bitsize int) (uint64, error) {
+	n, err := p.expectConst()
+	if err != nil {
+		return 0, err
+	}
+	return checkUnsigned(n, bitsize)
+}
+
+// expectSigned parses a two's complement immediate that fits in bitsize
+// bits.
+func (p *Parser) expectSigned(bitsize int) (int64, error) {
+	n, err := p.expectConst()
+	if err != nil {
+		return 0, err
+	}
+	return checkSigned(n, bitsize)
+}
+
+func checkUnsigned(n int64, bitsize int) (uint64, error) {
+	if max := int64(1)<<bitsize - 1; n < 0 || n > max {
+		return 0, fmt.Errorf("%d out of range [0, %d]", n, max)
+	}
+	return uint64(n), nil
+}
+
+func checkSigned(n int64, bitsize int) (int64, error) {
+	min, max := -int64(1)<<(bitsize-1), int64(1)<<(bitsize-1)-1
+	if n < min || n > max {
+		return 0, fmt.Errorf("%d out of range [%d, %d]", n, min, max)
 	}
 	return n, nil
 }
@@ -234,45 +748,55 @@ func offsetString(w io.Writer, addr Addr) {
 	fmt.Fprintf(w, "[%s,#%d]", addr.Reg, addr.Offset)
 }
 
-func (p *Parser) expectOffset(as *Instruction) (addr Addr, err error) {
+// expectOffset parses a base register and byte offset into as.From.
+func (p *Parser) expectOffset(as *Instruction) (err error) {
 	if _, err := p.expect(itemLbrack); err != nil {
-		return addr, err
+		return err
 	}
-	addr.Reg, err = p.expectRegister(as.registerPrefix())
+	as.From.Reg, err = p.expectRegister('X')
 	if err != nil {
-		return addr, err
+		return err
+	}
+	if p.has(itemRbrack) {
+		p.expect(itemRbrack)
+		return nil
 	}
 	if _, err := p.expect(itemComma); err != nil {
-		return addr, err
+		return err
 	}
-	addr.Offset, err = p.expectImmediate(32)
+	err = p.expectValue(as, "offset", func(as *Instruction, n int64) (err error) {
+		as.From.Offset, err = checkSigned(n, 9)
+		return err
+	})
 	if err != nil {
-		return addr, fmt.Errorf("offset: %v", err)
+		return err
 	}
-	if _, err := p.expect(itemRbrack); err != nil {
-		return addr, err
+	_, err = p.expect(itemRbrack)
+	return err
+}
+
+func addrString(w io.Writer, addr Addr) {
+	if addr.Label != "" {
+		fmt.Fprint(w, addr.Label)
+		return
 	}
-	return addr, nil
+	fmt.Fprint(w, addr.Offset)
 }
 
+// expectAddr parses a branch target: a label, or an offset in
+// instructions relative to the branch.
 func (p *Parser) expectAddr(as *Instruction) (addr Addr, err error) {
-	if p.has(itemInteger) {
-		// PC-relative address
-		off, err := p.expect(itemInteger)
-		if err != nil {
-			return addr, fmt.Errorf("to: %v", err)
+	if !p.has(itemName) {
+		// B and BL have 26 bits for the offset, the conditional branches 19
+		bits := 19
+		if as.Op == "B" || as.Op == "BL" {
+			bits = 26
 		}
-		addr.Offset, err = strconv.ParseUint(off, 10, 64)
-		if err != nil {
-			return addr, fmt.Errorf("to: %v", err)
-		}
-		return addr, nil
+		addr.Offset, err = p.expectSigned(bits)
+		return addr, err
 	}
 	addr.Label, err = p.expect(itemName)
-	if err != nil {
-		return addr, fmt.Errorf("to: %v", err)
-	}
-	return addr, nil
+	return addr, err
 }
 
 func (p *Parser) expectRegister(prefix rune) (Register, error) {
@@ -280,6 +804,12 @@ func (p *Parser) expectRegister(prefix rune) (Register, error) {
 	if err != nil {
 		return 0, err
 	}
+	return parseRegister(t, prefix)
+}
+
+// parseRegister returns the register named t, which must be in the bank
+// selected by prefix.
+func parseRegister(t string, prefix rune) (Register, error) {
 	if len(t) > 3 {
 		return 0, fmt.Errorf("not a register '%s'", t)
 	}
@@ -316,7 +846,7 @@ func (p *Parser) expectRegister(prefix rune) (Register, error) {
 			return IP1, nil
 		}
 	}
-	if rune(t[0]) != prefix {
+	if t == "" || rune(t[0]) != prefix {
 		return 0, fmt.Errorf("not a register '%s'", t)
 	}
 	n, err := strconv.ParseUint(t[1:], 10, 8)
@@ -325,3 +855,13 @@ func (p *Parser) expectRegister(prefix rune) (Register, error) {
 	}
 	return base + Register(n), nil
 }
+
+// ParseRegister returns the register of any bank named s, such as X9, LR,
+// S0 or D31.
+func ParseRegister(s string) (Register, error) {
+	prefix := 'X'
+	if strings.HasPrefix(s, "S") && s != "SP" || strings.HasPrefix(s, "D") {
+		prefix = rune(s[0])
+	}
+	return parseRegister(s, prefix)
+}
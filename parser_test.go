@@ -0,0 +1,172 @@
+package simleg
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Each immediate field is tried with the values just inside and just
+// outside its range.
+var rangeTests = []struct {
+	src string
+	ok  bool
+}{
+	// 12 bits, unsigned
+	{"ANDI X1,X2,#4095", true},
+	{"ANDI X1,X2,#4096", false},
+	{"ANDI X1,X2,#0", true},
+	{"ANDI X1,X2,#-1", false},
+	{"ADDI X1,X2,#0xFFF", true},
+	{"ADDI X1,X2,#0x1000", false},
+	{"ADDI X1,X2,#-4095", true},
+	{"ADDI X1,X2,#-4096", false},
+	{"CMPI X1,#4095", true},
+	{"CMPI X1,#-4095", true},
+	{"CMPI X1,#-4096", false},
+	// 6 bits, unsigned
+	{"LSL X1,X2,#63", true},
+	{"LSL X1,X2,#64", false},
+	{"LSR X1,X2,#-1", false},
+	// 9 bits, signed
+	{"LDUR X1,[X2,#255]", true},
+	{"LDUR X1,[X2,#256]", false},
+	{"STUR X1,[X2,#-256]", true},
+	{"STUR X1,[X2,#-257]", false},
+	// 16 bits, unsigned
+	{"MOVZ X1,#65535", true},
+	{"MOVZ X1,#65536", false},
+	{"MOVK X1,#0b1111111111111111,LSL #48", true},
+	{"MOVK X1,#-1", false},
+	// 19 bits, signed
+	{"CBZ X1,262143", true},
+	{"CBZ X1,262144", false},
+	{"CBNZ X1,-262144", true},
+	{"CBNZ X1,-262145", false},
+	{"B.EQ 262143", true},
+	{"B.EQ 262144", false},
+	{"B.LT -262144", true},
+	{"B.LT -262145", false},
+	// 26 bits, signed
+	{"B 33554431", true},
+	{"B 33554432", false},
+	{"BL -33554432", true},
+	{"BL -33554433", false},
+}
+
+func TestRanges(t *testing.T) {
+	for _, tt := range rangeTests {
+		p := &Parser{Filename: "test.asm"}
+		p.Use(strings.NewReader(tt.src))
+		_, err := p.ParseAll()
+		switch {
+		case tt.ok && err != nil:
+			t.Errorf("%s: %v", tt.src, err)
+		case !tt.ok && err == nil:
+			t.Errorf("%s: accepted", tt.src)
+		case !tt.ok && !strings.Contains(err.Error(), "out of range"):
+			t.Errorf("%s: %v, want a range error", tt.src, err)
+		}
+	}
+}
+
+func TestNegativeImmediates(t *testing.T) {
+	for _, tt := range []struct{ src, parsed, expanded string }{
+		{"ADDI X1,X2,#-5", "SUBI X1,X2,#5", "SUBI X1,X2,#5"},
+		{"SUBIS X1,X2,#-5", "ADDIS X1,X2,#5", "ADDIS X1,X2,#5"},
+		{"CMPI X1,#5", "CMPI X1,#5", "SUBIS XZR,X1,#5"},
+		{"CMPI X1,#-5", "CMNI X1,#5", "ADDIS XZR,X1,#5"},
+		{"CMNI X1,#-5", "CMPI X1,#5", "SUBIS XZR,X1,#5"},
+	} {
+		prog := parse(t, tt.src)
+		if got := strings.TrimSpace(prog.String()); got != tt.parsed {
+			t.Errorf("%s parses as %s, want %s", tt.src, got, tt.parsed)
+		}
+		if got := strings.TrimSpace(prog.Expand().String()); got != tt.expanded {
+			t.Errorf("%s expands to %s, want %s", tt.src, got, tt.expanded)
+		}
+	}
+}
+
+// writeFiles writes each file to a new directory, and returns its path.
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, src := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(src), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestPositions(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.asm": ".macro inc r\n        ADDI \\r,\\r,#1\n.endm\n        inc X1\n  .include \"lib.asm\"\n        B 0\n",
+		"lib.asm":  "// lib\n   SUBI X2,X2,#2\n\tinc X3\n   ADDI X1,,X2\n\tinc Q1\n",
+	})
+	p := &Parser{}
+	prog, err := p.ParseFiles(filepath.Join(dir, "main.asm"))
+	var got []string
+	for _, as := range prog {
+		got = append(got, as.Pos.String()+" "+as.String())
+	}
+	if errs, ok := err.(ErrorList); ok {
+		for _, e := range errs {
+			got = append(got, e.Error())
+		}
+	} else {
+		t.Errorf("ParseFiles = %v, want an ErrorList", err)
+	}
+	want := []string{
+		"main.asm:2:9 ADDI X1,X1,#1",
+		"lib.asm:2:4 SUBI X2,X2,#2",
+		"main.asm:2:9 ADDI X3,X3,#1",
+		"main.asm:6:9 B 0",
+		"lib.asm:4:12: first operand: unexpected token ','",
+		"main.asm:2:14: to: not a register 'Q1'",
+	}
+	for i := range got {
+		got[i] = strings.ReplaceAll(got[i], dir+string(filepath.Separator), "")
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("parsed\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestParseAllResumes(t *testing.T) {
+	p := &Parser{Filename: "test.asm"}
+	p.Use(strings.NewReader(`ADDI X1,X1,#nowhere
+ADD X1,X2
+SUB X1,X2,X3
+FOO X1 ADD X2,X2,X2
+start:	ADD X1,X1,X1
+start:	B start`))
+	prog, err := p.ParseAll()
+	var got []string
+	for _, as := range prog {
+		got = append(got, as.String())
+	}
+	if got, want := strings.Join(got, "; "), "ADDI X1,X1,#0; SUB X1,X2,X3; start: ADD X1,X1,X1; start: B start"; got != want {
+		t.Errorf("parsed %s, want %s", got, want)
+	}
+	errs, ok := err.(ErrorList)
+	if !ok {
+		t.Fatalf("ParseAll = %v, want an ErrorList", err)
+	}
+	want := []string{
+		"test.asm:1:12: immediate: undefined symbol 'nowhere'",
+		"test.asm:2:10: unexpected newline",
+		"test.asm:4:1: opcode not supported: FOO",
+		"test.asm:6:1: start redefined",
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("got %d errors, want %d: %v", len(errs), len(want), errs)
+	}
+	for i, e := range errs {
+		if e.Error() != want[i] {
+			t.Errorf("error %d = %s, want %s", i, e, want[i])
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package simleg
+
+import (
+	"fmt"
+	"io"
+)
+
+var (
+	movformat  = insFormat{p: movformatParser, s: movformatString}
+	cmpformat  = insFormat{p: fcformatParser, s: fcformatString}
+	cmpiformat = insFormat{p: cmpiformatParser, s: cmpiformatString}
+	ldaformat  = insFormat{p: ldaformatParser, s: ldaformatString}
+	moviformat = insFormat{p: moviformatParser, s: moviformatString}
+)
+
+// pseudoOps maps each pseudo-instruction to the function that expands it
+// into real instructions.
+var pseudoOps = map[string]func(as Instruction) Program{
+	"MOV": func(as Instruction) Program {
+		return Program{{Op: "ORR", To: as.To, From: Addr{Reg: XZR}, Reg: as.From.Reg}}
+	},
+	"NEG": func(as Instruction) Program {
+		return Program{{Op: "SUB", To: as.To, From: Addr{Reg: XZR}, Reg: as.From.Reg}}
+	},
+	"CMP": func(as Instruction) Program {
+		return Program{{Op: "SUBS", To: Addr{Reg: XZR}, From: as.From, Reg: as.Reg}}
+	},
+	"CMPI": func(as Instruction) Program {
+		return Program{{Op: "SUBIS", To: Addr{Reg: XZR}, From: as.From, Imm: as.Imm}}
+	},
+	// CMNI compares with the negation of its immediate, and stands in for
+	// CMPI with a negative one
+	"CMNI": func(as Instruction) Program {
+		return Program{{Op: "ADDIS", To: Addr{Reg: XZR}, From: as.From, Imm: as.Imm}}
+	},
+	// addresses fit in 32 bits, so LDA always takes two instructions
+	"LDA": func(as Instruction) Program {
+		return Program{
+			{Op: "MOVZ", To: as.To, Imm: as.Imm & 0xFFFF},
+			{Op: "MOVK", To: as.To, Imm: as.Imm >> 16, Shift: 16},
+		}
+	},
+	// MOVI sets the low 16 bits and then each other non-zero chunk
+	"MOVI": func(as Instruction) Program {
+		prog := Program{{Op: "MOVZ", To: as.To, Imm: as.Imm & 0xFFFF}}
+		for shift := uint8(16); shift < 64; shift += 16 {
+			if c := as.Imm >> shift & 0xFFFF; c != 0 {
+				prog = append(prog, Instruction{Op: "MOVK", To: as.To, Imm: c, Shift: shift})
+			}
+		}
+		return prog
+	},
+}
+
+// expand returns the real instructions that as stands for. Each refers
+// back to as through its Pseudo field, and the first takes its label.
+func (as Instruction) expand() Program {
+	fn, ok := pseudoOps[as.Op]
+	if !ok {
+		return Program{as}
+	}
+	pseudo := as
+	prog := fn(as)
+	for i := range prog {
+		prog[i].Pos = as.Pos
+		prog[i].Pseudo = &pseudo
+	}
+	prog[0].Label = as.Label
+	return prog
+}
+
+// Expand returns p with its pseudo-instructions replaced by real ones that
+// no longer refer back to them, so String prints the expansions.
+func (p Program) Expand() Program {
+	var prog Program
+	for _, as := range p {
+		for _, ex := range as.expand() {
+			ex.Pseudo = nil
+			prog = append(prog, ex)
+		}
+	}
+	return prog
+}
+
+func movformatString(w io.Writer, as Instruction) {
+	fmt.Fprintf(w, "%s,%s", as.To.Reg, as.From.Reg)
+}
+
+func movformatParser(p *Parser, as *Instruction) (err error) {
+	as.To.Reg, err = p.expectRegister(as.registerPrefix())
+	if err != nil {
+		return fmt.Errorf("to: %v", err)
+	}
+	if _, err = p.expect(itemComma); err != nil {
+		return err
+	}
+	as.From.Reg, err = p.expectRegister(as.registerPrefix())
+	if err != nil {
+		return fmt.Errorf("from: %v", err)
+	}
+	return nil
+}
+
+func cmpiformatString(w io.Writer, as Instruction) {
+	fmt.Fprintf(w, "%s,#%d", as.From.Reg, as.Imm)
+}
+
+func cmpiformatParser(p *Parser, as *Instruction) (err error) {
+	as.From.Reg, err = p.expectRegister(as.registerPrefix())
+	if err != nil {
+		return fmt.Errorf("first operand: %v", err)
+	}
+	if _, err = p.expect(itemComma); err != nil {
+		return err
+	}
+	return p.expectValue(as, "immediate", setIformatImm)
+}
+
+func ldaformatString(w io.Writer, as Instruction) {
+	if as.From.Label != "" {
+		fmt.Fprintf(w, "%s,%s", as.To.Reg, as.From.Label)
+		return
+	}
+	fmt.Fprintf(w, "%s,#%d", as.To.Reg, as.Imm)
+}
+
+// ldaformatParser parses the address operand of LDA, which is usually
+// a label but may be any expression.
+func ldaformatParser(p *Parser, as *Instruction) (err error) {
+	as.To.Reg, err = p.expectRegister(as.registerPrefix())
+	if err != nil {
+		return fmt.Errorf("to: %v", err)
+	}
+	if _, err = p.expect(itemComma); err != nil {
+		return err
+	}
+	pos := p.peek().pos
+	e, err := p.parseExpr()
+	if err != nil {
+		return fmt.Errorf("address: %v", err)
+	}
+	if sym, ok := e.(symExpr); ok {
+		as.From.Label = string(sym)
+	}
+	return p.setValue(as, e, pos, "address", relocSite{kind: RelocAddr32}, func(as *Instruction, n int64) (err error) {
+		as.Imm, err = checkUnsigned(n, 32)
+		return err
+	})
+}
+
+func moviformatString(w io.Writer, as Instruction) {
+	fmt.Fprintf(w, "%s,#%d", as.To.Reg, int64(as.Imm))
+}
+
+// moviformatParser parses MOVI, whose immediate must be known right away
+// because it decides the length of the expansion.
+func moviformatParser(p *Parser, as *Instruction) (err error) {
+	as.To.Reg, err = p.expectRegister(as.registerPrefix())
+	if err != nil {
+		return fmt.Errorf("to: %v", err)
+	}
+	if _, err = p.expect(itemComma); err != nil {
+		return err
+	}
+	n, err := p.expectConst()
+	if err != nil {
+		return fmt.Errorf("immediate: %v", err)
+	}
+	as.Imm = uint64(n)
+	return nil
+}
@@ -0,0 +1,226 @@
+package simleg
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+)
+
+// A Breakpoint stops Run before the instruction at an address, given by
+// Label, by the File and Line of source the instruction was parsed from,
+// or else by Addr. A line without code stands for the next one that has
+// some, and File may leave out the directory.
+type Breakpoint struct {
+	Addr  uint64
+	Label string
+	File  string
+	Line  int
+}
+
+// A Watchpoint stops Run after an instruction that accesses any of the
+// Size bytes at Addr in one of the ways given by Kind.
+type Watchpoint struct {
+	Addr uint64
+	Size uint64
+	Kind AccessKind
+}
+
+// RunOptions says where Run should stop besides the end of the program.
+type RunOptions struct {
+	Breakpoints []Breakpoint
+	Watchpoints []Watchpoint
+	Registers   []Register // stop after an instruction changes one of these
+	MaxSteps    int        // stop after this many instructions, if not 0
+
+	// Until, if not nil, is called with each instruction after it runs,
+	// and stops Run if it returns true.
+	Until func(as Instruction) bool
+}
+
+// StopReason is why Run stopped.
+type StopReason uint8
+
+const (
+	StopExited StopReason = iota // PC moved past the last instruction
+	StopFault                    // an instruction could not be run
+	StopBreakpoint
+	StopWatchpoint
+	StopRegister
+	StopStepLimit
+	StopUntil
+	StopCanceled
+	StopHistoryStart // ReverseContinue undid every instruction recorded
+)
+
+var stopReasons = [...]string{"exited", "fault", "breakpoint", "watchpoint", "register", "step limit", "until", "canceled", "start of history"}
+
+func (r StopReason) String() string {
+	if int(r) < len(stopReasons) {
+		return stopReasons[r]
+	}
+	return fmt.Sprintf("StopReason(%d)", r)
+}
+
+// A Stop describes where and why Run stopped.
+type Stop struct {
+	Reason StopReason
+	PC     uint64
+	Steps  int // instructions run
+
+	Breakpoint int      // index in RunOptions.Breakpoints
+	Watchpoint int      // index in RunOptions.Watchpoints
+	Access     Access   // that hit the watchpoint; Data is a copy
+	Register   Register // that changed
+	Old, New   uint64   // values of the register
+}
+
+// Run runs the program until it ends or one of the conditions in opts is
+// met, and returns why it stopped. Run does not stop at a breakpoint on
+// the instruction PC points to when it starts, so it can be called again
+// to carry on. If an instruction fails, Run returns its *ExecError, and if
+// ctx is done, it returns ctx.Err().
+func (cpu *CPU) Run(ctx context.Context, opts RunOptions) (Stop, error) {
+	breaks, err := cpu.breakpoints(opts.Breakpoints)
+	if err != nil {
+		return Stop{PC: cpu.PC}, err
+	}
+
+	var stop Stop
+	watched := false
+	if len(opts.Watchpoints) > 0 && cpu.Memory != nil {
+		remove := cpu.Memory.Hook(func(a Access) {
+			if a.CPU != cpu || watched {
+				return
+			}
+			for i, w := range opts.Watchpoints {
+				if w.Kind&a.Kind != 0 && a.Addr < w.Addr+w.Size && w.Addr < a.Addr+uint64(len(a.Data)) {
+					watched = true
+					stop.Watchpoint = i
+					stop.Access = a
+					stop.Access.Data = append([]byte(nil), a.Data...)
+					return
+				}
+			}
+		})
+		defer remove()
+	}
+
+	regs := make([]uint64, len(opts.Registers))
+	for {
+		stop.PC = cpu.PC
+		select {
+		case <-ctx.Done():
+			stop.Reason = StopCanceled
+			return stop, ctx.Err()
+		default:
+		}
+		if opts.MaxSteps > 0 && stop.Steps >= opts.MaxSteps {
+			stop.Reason = StopStepLimit
+			return stop, nil
+		}
+		if _, ok := cpu.Instruction(cpu.PC); !ok && cpu.Err == nil {
+			stop.Reason = StopExited
+			return stop, nil
+		}
+		for i, r := range opts.Registers {
+			regs[i] = cpu.register(r)
+		}
+
+		as, running, err := cpu.step()
+		stop.PC = cpu.PC
+		if err != nil {
+			stop.Reason = StopFault
+			return stop, err
+		}
+		stop.Steps++
+		if watched {
+			stop.Reason = StopWatchpoint
+			return stop, nil
+		}
+		for i, r := range opts.Registers {
+			if v := cpu.register(r); v != regs[i] {
+				stop.Reason = StopRegister
+				stop.Register, stop.Old, stop.New = r, regs[i], v
+				return stop, nil
+			}
+		}
+		if !running {
+			stop.Reason = StopExited
+			return stop, nil
+		}
+		if opts.Until != nil && opts.Until(as) {
+			stop.Reason = StopUntil
+			return stop, nil
+		}
+		if i, ok := breaks[cpu.PC]; ok {
+			stop.Reason = StopBreakpoint
+			stop.Breakpoint = i
+			return stop, nil
+		}
+	}
+}
+
+// register returns the value of r, or the raw bits of a floating point
+// register.
+func (cpu *CPU) register(r Register) uint64 {
+	if r >= S0 {
+		return cpu.FPRegisters[r.Num()]
+	}
+	return cpu.Registers[r]
+}
+
+// breakpoints maps the address of each of bs to its index.
+func (cpu *CPU) breakpoints(bs []Breakpoint) (map[uint64]int, error) {
+	breaks := make(map[uint64]int)
+	for i, b := range bs {
+		addr, err := cpu.breakpointAddr(b)
+		if err != nil {
+			return nil, fmt.Errorf("breakpoint %d: %v", i, err)
+		}
+		if _, ok := breaks[addr]; !ok {
+			breaks[addr] = i
+		}
+	}
+	return breaks, nil
+}
+
+// breakpointAddr returns the address of the instruction b refers to.
+func (cpu *CPU) breakpointAddr(b Breakpoint) (uint64, error) {
+	switch {
+	case b.Label != "":
+		addr, ok := cpu.labels[b.Label]
+		if !ok {
+			return 0, fmt.Errorf("undefined label '%s'", b.Label)
+		}
+		return addr, nil
+	case b.Line != 0:
+		return cpu.LineAddr(b.File, b.Line)
+	}
+	if _, ok := cpu.Instruction(b.Addr); !ok {
+		return 0, fmt.Errorf("no instruction at %#x", b.Addr)
+	}
+	return b.Addr, nil
+}
+
+// LineAddr returns the address of the first instruction parsed from line
+// of file, or from the next line after it that has any. file may leave out
+// the directory, or be "" for the file of the first instruction.
+func (cpu *CPU) LineAddr(file string, line int) (uint64, error) {
+	if file == "" && len(cpu.prog) > 0 {
+		file = cpu.prog[0].Pos.File
+	}
+	best := -1
+	for i, as := range cpu.prog {
+		pos := as.Pos
+		if pos.File != file && filepath.Base(pos.File) != file || pos.Line < line {
+			continue
+		}
+		if best < 0 || pos.Line < cpu.prog[best].Pos.Line {
+			best = i
+		}
+	}
+	if best < 0 {
+		return 0, fmt.Errorf("no code at or after line %d of %s", line, file)
+	}
+	return TextOffset + 4*uint64(best), nil
+}
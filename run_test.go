@@ -0,0 +1,78 @@
+package simleg
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// A watchpoint or register that triggers on the last instruction is
+// reported before the program is reported to have exited.
+func TestRunLastInstruction(t *testing.T) {
+	for _, tt := range []struct {
+		src  string
+		opts RunOptions
+		want StopReason
+	}{
+		{
+			"SUBI SP,SP,#8\nSTUR XZR,[SP,#0]\n",
+			RunOptions{Watchpoints: []Watchpoint{{Addr: StackOffset - 8, Size: 8, Kind: AccessWrite}}},
+			StopWatchpoint,
+		},
+		{
+			"SUBI SP,SP,#8\nADDI X2,XZR,#7\n",
+			RunOptions{Registers: []Register{X2}},
+			StopRegister,
+		},
+		{
+			"SUBI SP,SP,#8\nADDI X2,XZR,#7\n",
+			RunOptions{Registers: []Register{X3}},
+			StopExited,
+		},
+	} {
+		var cpu CPU
+		if err := cpu.Load(parse(t, tt.src)); err != nil {
+			t.Fatal(err)
+		}
+		stop, err := cpu.Run(context.Background(), tt.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stop.Reason != tt.want || stop.Steps != 2 {
+			t.Errorf("%q: stopped for %s after %d steps, want %s after 2", tt.src, stop.Reason, stop.Steps, tt.want)
+		}
+		stop, err = cpu.Run(context.Background(), tt.opts)
+		if err != nil || stop.Reason != StopExited || stop.Steps != 0 {
+			t.Errorf("%q: run again: stopped for %s after %d steps (%v), want exited", tt.src, stop.Reason, stop.Steps, err)
+		}
+	}
+}
+
+// Until is passed the instruction that ran, even when the program has
+// patched it in memory.
+func TestRunUntilPatched(t *testing.T) {
+	var cpu CPU
+	src := "MOVZ X9,#64,LSL #16\nSTURW X2,[X9,#8]\nADDI X1,XZR,#1\nADDI X3,XZR,#3"
+	if err := cpu.LoadText(parse(t, src)); err != nil {
+		t.Fatal(err)
+	}
+	w, err := Instruction{Op: "SUBI", To: Addr{Reg: X1}, From: Addr{Reg: XZR}, Imm: 1}.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu.Registers[X2] = uint64(w)
+	var ran []string
+	stop, err := cpu.Run(context.Background(), RunOptions{Until: func(as Instruction) bool {
+		ran = append(ran, as.Op)
+		return as.Pos.Line == 3
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(ran, " "), "MOVZ STURW SUBI"; got != want || stop.Reason != StopUntil {
+		t.Errorf("stopped for %s after %s, want until after %s", stop.Reason, got, want)
+	}
+	if cpu.Registers[X1] != neg(1) {
+		t.Errorf("X1 = %#x, want -1", cpu.Registers[X1])
+	}
+}
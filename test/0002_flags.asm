@@ -0,0 +1,60 @@
+// Checks every condition code. X0 ends up 1 if each branch went the
+// expected way, and 0 otherwise.
+      SUB X0,X0,X0
+      ADDI X1,X0,#1      // X1 = 1
+      ADDI X2,X0,#2      // X2 = 2
+      LSL X3,X1,#62      // X3 = 2^62
+
+      SUBS X9,X1,X1      // 1-1 sets Z,C
+      B.EQ eq
+      B done
+eq:   B.NE done
+      B.HS hs
+      B done
+hs:   B.LO done
+      B.LS ls
+      B done
+ls:   B.HI done
+      B.GE ge
+      B done
+ge:   B.LT done
+      B.LE le
+      B done
+le:   B.GT done
+
+      SUBS X9,X1,X2      // 1-2 sets N
+      B.MI mi
+      B done
+mi:   B.PL done
+      B.LT lt
+      B done
+lt:   B.LO lo
+      B done
+lo:   B.VS done
+
+      SUBS X9,X2,X1      // 2-1 sets C
+      B.HI hi
+      B done
+hi:   B.GT gt
+      B done
+gt:   B.PL pl
+      B done
+pl:   B.VC vc
+      B done
+
+vc:   ADDS X9,X3,X3      // 2^62+2^62 sets N,V
+      B.VS vs
+      B done
+vs:   B.GE ge2
+      B done
+ge2:  B.LO lo2
+      B done
+lo2:  ANDIS X9,X1,#2     // 1&2 sets Z, clears C,V
+      B.EQ eq2
+      B done
+eq2:  B.VS done
+      B.LO pass
+      B done
+
+pass: ADDI X0,X1,#0
+done: ORR X9,X9,X9
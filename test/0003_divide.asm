@@ -0,0 +1,33 @@
+// Checks division and high multiplies. X0 ends up 1 if every result
+// matched, and 0 otherwise.
+      SUB X0,X0,X0
+      ADDI X1,X0,#7      // X1 = 7
+      ADDI X2,X0,#2      // X2 = 2
+      SUB X3,X0,X1       // X3 = -7
+      LSL X4,X2,#62      // X4 = 2^63
+
+      UDIV X9,X1,X2      // 7/2 = 3
+      SUBIS X9,X9,#3
+      B.NE done
+      SDIV X9,X3,X2      // -7/2 = -3
+      ADDIS X9,X9,#3
+      B.NE done
+      SDIV X9,X1,X0      // 7/0 = 0
+      CBNZ X9,done
+      UDIV X9,X1,X0      // 7/0 = 0
+      CBNZ X9,done
+
+      UMULH X9,X4,X2     // 2^63*2 = 2^64, high half 1
+      SUBIS X9,X9,#1
+      B.NE done
+      SMULH X9,X4,X2     // -2^63*2 = -2^64, high half -1
+      ADDIS X9,X9,#1
+      B.NE done
+      SMULH X9,X3,X1     // -7*7 = -49, high half -1
+      ADDIS X9,X9,#1
+      B.NE done
+      UMULH X9,X1,X1     // 7*7 = 49, high half 0
+      CBNZ X9,done
+
+      ADDI X0,X0,#1
+done: ORR X9,X9,X9
@@ -0,0 +1,43 @@
+// Checks single and double precision arithmetic. X0 ends up 1 if every
+// result matched, and 0 otherwise.
+      SUB X0,X0,X0
+      MOVZ X1,#16376,LSL #48   // 1.5 as a double
+      MOVZ X2,#16392,LSL #48   // 3.0 as a double
+      MOVZ X3,#16320,LSL #16   // 1.5 as a single
+      MOVZ X4,#16448,LSL #16   // 3.0 as a single
+      SUBI SP,SP,#16
+      STUR X1,[SP,#0]
+      STURW X3,[SP,#8]
+
+      LDURD D1,[SP,#0]
+      FADDD D2,D1,D1           // 1.5+1.5
+      FCMPD D1,D2
+      B.PL done
+      FSUBD D3,D2,D1           // 3.0-1.5
+      FCMPD D3,D1
+      B.NE done
+      FMULD D4,D1,D1           // 1.5*1.5
+      FDIVD D4,D4,D1
+      FCMPD D4,D1
+      B.NE done
+      STURD D2,[SP,#0]
+      LDUR X9,[SP,#0]
+      SUBS X9,X9,X2
+      B.NE done
+
+      LDURS S1,[SP,#8]
+      FADDS S2,S1,S1
+      FCMPS S2,S1
+      B.LE done
+      FSUBS S3,S2,S1
+      FMULS S3,S3,S1
+      FDIVS S3,S3,S1
+      FCMPS S3,S1
+      B.NE done
+      STURS S2,[SP,#8]
+      LDURSW X9,[SP,#8]
+      SUBS X9,X9,X4
+      B.NE done
+
+      ADDI X0,X0,#1
+done: ADDI SP,SP,#16
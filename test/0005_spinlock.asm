@@ -0,0 +1,28 @@
+// Each core adds 100 to a shared counter, taking a spinlock around every
+// increment. Run with several cores and print the counter at the end,
+// e.g. simleg -cores 4 -x 0x600008; it ends up 100 times the number of
+// cores.
+        MOVZ X20,#96,LSL #16  // X20 = 0x600000: lock, counter, ready flag
+        MOVZ X12,#4660        // ready marker
+        SUB X9,X9,X9
+        CBNZ X0,wait          // core 0 sets up the shared words
+        STUR X9,[X20,#0]      // lock = 0
+        STUR X9,[X20,#8]      // counter = 0
+        STUR X12,[X20,#16]    // ready
+wait:   LDUR X10,[X20,#16]
+        SUBS X10,X10,X12
+        B.NE wait
+        ADDI X19,X9,#100
+
+loop:   MOVZ X11,#1
+lock:   LDXR X10,[X20,#0]
+        CBNZ X10,lock         // spin while held
+        STXR X11,X9,[X20]     // try to take it; X9 = 0 on success
+        CBNZ X9,lock
+        LDUR X10,[X20,#8]
+        ADDI X10,X10,#1
+        STUR X10,[X20,#8]
+        STUR X9,[X20,#0]      // release
+        SUBI X19,X19,#1
+        CBNZ X19,loop
+        LDUR X1,[X20,#8]
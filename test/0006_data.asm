@@ -0,0 +1,26 @@
+// Sums an array and measures a string in the data segment. X0 ends up
+// 150, the sum of nums, and X1 13, the length of msg.
+        .data
+nums:   .word 10,20,30,40,50
+msg:    .asciz "Hello, world!"
+        .align 3
+buf:    .space 16
+
+        .text
+        SUB X0,X0,X0
+        LDA X9,nums
+        ADDI X10,X0,#5      // elements left
+sum:    LDURSW X11,[X9,#0]
+        ADD X0,X0,X11
+        ADDI X9,X9,#4
+        SUBI X10,X10,#1
+        CBNZ X10,sum
+
+        SUB X1,X1,X1
+        LDA X9,msg
+len:    LDURB X11,[X9,#0]
+        CBZ X11,done
+        ADDI X1,X1,#1
+        ADDI X9,X9,#1
+        B len
+done:   STUR X0,[X9,#0]
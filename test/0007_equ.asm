@@ -0,0 +1,24 @@
+// Walks a table of records using symbolic sizes and offsets. X0 ends up
+// 60, the sum of the values, and X1 3, the number of records.
+        .equ VALUE, 8           // offset of the value in a record
+        .equ RECORD, VALUE+8    // size of a record
+
+        .data
+table:  .dword 1, 10
+        .dword 2, 20
+        .dword 3, 30
+table_end:
+
+        .text
+        SUB X0,X0,X0
+        ADDI X1,X0,#COUNT
+        ADDI X2,X1,#0
+        LDA X9,table
+loop:   LDUR X10,[X9,#VALUE]
+        ADD X0,X0,X10
+        ADDI X9,X9,#RECORD
+        SUBI X2,X2,#1
+        CBNZ X2,loop
+done:   STUR X0,[X9,#-RECORD*COUNT]
+
+        .equ COUNT, (table_end-table)/RECORD
@@ -0,0 +1,38 @@
+// Computes 5! recursively, saving registers with push and pop macros.
+// X0 ends up 120.
+        .macro push reg
+        SUBI SP,SP,#8
+        STUR \reg,[SP,#0]
+        .endm
+
+        .macro pop reg
+        LDUR \reg,[SP,#0]
+        ADDI SP,SP,#8
+        .endm
+
+        // sets \reg to 1 if it is zero, using a label local to the expansion
+        .macro atleast1 reg
+        CBNZ \reg,nz\@
+        ADDI \reg,\reg,#1
+nz\@:   ADDI \reg,\reg,#0
+        .endm
+
+        SUB X0,X0,X0
+        ADDI X0,X0,#5
+        BL fact
+        B done
+
+// fact returns X0! in X0.
+fact:   push LR
+        push X0
+        SUBI X0,X0,#1
+        CBZ X0,base
+        BL fact
+        B ret
+base:   atleast1 X0
+ret:    pop X1
+        MUL X0,X0,X1
+        pop LR
+        BR LR
+
+done:   STUR X0,[SP,#-8]
@@ -0,0 +1,23 @@
+// Exercises the pseudo-instructions. X0 ends up 1 if each one gave the
+// expected result, and 0 otherwise.
+        MOV X0,XZR
+        MOVI X1,#0x123456789
+        MOVI X2,#0x123456788
+        CMP X1,X2
+        B.LE done
+        NEG X3,X1
+        ADD X3,X3,X2        // X3 = -1
+        ADDI X3,X3,#1
+        CBNZ X3,done
+        MOVI X4,#-2
+        CMP X4,XZR
+        B.GE done
+        CMPI X4,#-2
+        B.NE done
+        CMPI X2,#5
+        B.LS done
+        LDA X6,jump         // branch through a register
+        BR X6
+        B done
+jump:   ADDI X0,XZR,#1
+done:   MOV X9,X0
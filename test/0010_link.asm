@@ -0,0 +1,13 @@
+// Calls sum from the course library. Run with
+//      simleg test/0010_link.asm test/lib/sum.asm
+// X0 ends up 55, and X2 1 since the loop labels of the two files are
+// kept apart.
+        .include "lib/consts.asm"
+
+        MOV X19,LR          // returning from main ends the program
+        MOVI X0,#COUNT
+        BL sum
+        MOV X2,XZR
+loop:   ADDI X2,X2,#1
+        MOV LR,X19
+        BR LR
@@ -0,0 +1,20 @@
+// Links against the course library assembled on its own:
+//      simleg asm -o sum.o test/lib/sum.asm
+//      simleg test/0011_object.asm sum.o
+// ptrs holds addresses the linker fills in, so X0 ends up 55, the sum
+// of 1 to count, and X1 20.
+        .data
+count:  .dword 10
+ptrs:   .dword count,table+8
+table:  .dword 10,20,30
+
+        .text
+        MOV X19,LR          // returning from main ends the program
+        LDA X9,ptrs
+        LDUR X10,[X9,#0]
+        LDUR X0,[X10,#0]
+        BL sum
+        LDUR X10,[X9,#8]
+        LDUR X1,[X10,#0]
+        MOV LR,X19
+        BR LR
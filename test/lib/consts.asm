@@ -0,0 +1,2 @@
+// Constants shared by the samples that include this file.
+        .equ COUNT, 10
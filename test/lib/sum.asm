@@ -0,0 +1,8 @@
+// sum returns 1+2+...+X0 in X0. Link it with the program that calls it.
+        .global sum
+sum:    MOV X1,X0
+        MOV X0,XZR
+loop:   ADD X0,X0,X1
+        SUBI X1,X1,#1
+        CBNZ X1,loop
+        BR LR